@@ -1,28 +1,60 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"golang.org/x/exp/slog"
 )
 
 const (
 	exitFail = 1
+	// envToken is the environment variable with the bearer token, the -token flag overrides it
+	envToken = "RAMPUP_TOKEN"
+	// encodingBase64 marks a value in a JSON body that the server sent base64 encoded, because it isn't valid UTF-8
+	encodingBase64 = "base64"
 )
 
 type requestError struct {
 	code int
+	// problem is the problem document the server sent with the error, if any
+	problem *problem
 }
 
 func (e *requestError) Error() string {
-	return fmt.Sprintf("the request returned with http code: %d", e.code)
+	if e.problem == nil {
+		return fmt.Sprintf("the request returned with http code: %d", e.code)
+	}
+	msg := fmt.Sprintf("the request returned with http code: %d (%s): %s", e.code, e.problem.Code, strings.TrimPrefix(e.problem.Detail, "error: "))
+	if e.problem.Limit != nil {
+		msg += fmt.Sprintf(", the limit is %d", *e.problem.Limit)
+	}
+	return msg
+}
+
+// problem is the RFC 7807 problem document the server answers errors with.
+type problem struct {
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Code   string `json:"code"`
+	Limit  *int   `json:"limit"`
+	Key    string `json:"key"`
 }
 
 func main() {
@@ -36,26 +68,169 @@ func main() {
 
 type client struct {
 	log *slog.Logger
+	// token is sent as the bearer token of every request
+	token string
+	// http sends the requests, nil uses http.DefaultClient
+	http *http.Client
+	// ifMatch and ifNoneMatch are sent as the If-Match and If-None-Match headers of writes
+	ifMatch     string
+	ifNoneMatch string
+	// etag is the ETag of the last successful put
+	etag string
+	// contentType and contentEncoding are sent as the Content-Type and Content-Encoding of puts
+	contentType     string
+	contentEncoding string
 }
 
 func run(args []string, log *slog.Logger) error {
 	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
 	var (
 		host   = flags.String("host", "http://localhost:8080", "The host to send the request")
+		ns     = flags.String("ns", "", "The namespace of the keys, empty uses the default keyspace")
+		token  = flags.String("token", os.Getenv(envToken), "The bearer token of the requests, defaults to "+envToken)
 		method = flags.String("m", "", "The http method to be used")
 		key    = flags.String("key", "", "The key of the request")
 		value  = flags.String("value", "", "The value to be set for a key")
+		file   = flags.String("file", "", "The file with the value to be set for a key, - reads from stdin")
+		out    = flags.String("out", "", "The file the value of a get is written to instead of stdout")
+
+		contentType     = flags.String("content-type", "", "The Content-Type of a put value, defaults to text/plain or the type of the file")
+		contentEncoding = flags.String("content-encoding", "", "The Content-Encoding of a put value, e.g. gzip")
+		ttl             = flags.String("ttl", "", "The time to live of a put value, e.g. 30s or 1h")
+
+		ifMatch     = flags.String("if-match", "", "Only write if the entry has this ETag, e.g. '\"42\"' or '*'")
+		ifNoneMatch = flags.String("if-none-match", "", "Only write if the entry doesn't have this ETag, '*' only creates new keys")
+		printETag   = flags.Bool("print-etag", false, "Print the ETag of the written entry")
+
+		prefix = flags.String("prefix", "", "Only list keys with this prefix")
+		limit  = flags.Int("limit", 0, "The number of keys fetched per request of a list, 0 uses the server default")
+		values = flags.Bool("values", false, "List the values of the keys as well")
+
+		ops = flags.String("ops", "-", "The file with the operations of a batch as JSON array or one JSON object per line, - reads from stdin")
+
+		rev = flags.Uint64("rev", 0, "The revision to start a watch from, 0 only prints new changes")
+
+		by = flags.Int64("by", 1, "The amount an incr adds to the value, negative amounts decrement it")
+
+		tlsCA   = flags.String("tls-ca", "", "A PEM bundle of the CAs to trust for https hosts instead of the system ones")
+		tlsCert = flags.String("tls-cert", "", "A PEM client certificate for servers that require one, needs -tls-key")
+		tlsKey  = flags.String("tls-key", "", "The PEM private key of -tls-cert")
 	)
 	if err := flags.Parse(args[1:]); err != nil {
 		return err
 	}
+	httpClient, err := newHTTPClient(*tlsCA, *tlsCert, *tlsKey)
+	if err != nil {
+		return err
+	}
+	// api is the base of the routes, the routes of a namespace are below /v1/ns/{ns}
+	api := *host + "/v1"
+	if *ns != "" {
+		api += "/ns/" + url.PathEscape(*ns)
+	}
+	if *method == "watch" {
+		if *value != "" || (*key != "" && *prefix != "") {
+			return fmt.Errorf("using 'watch' method with value or both key and prefix is not possible")
+		}
+		params := url.Values{}
+		if *key != "" {
+			params.Set("key", *key)
+		} else {
+			params.Set("prefix", *prefix)
+		}
+		if *rev > 0 {
+			params.Set("rev", strconv.FormatUint(*rev, 10))
+		}
+		c := client{log: log, token: *token, http: httpClient}
+		return c.watch(fmt.Sprintf("%s/watch?%s", api, params.Encode()), os.Stdout)
+	}
+	if *method == "batch" {
+		if *key != "" || *value != "" {
+			return fmt.Errorf("using 'batch' method with key or value is not possible")
+		}
+		in := os.Stdin
+		if *ops != "-" {
+			f, err := os.Open(*ops)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		c := client{log: log, token: *token, http: httpClient}
+		out, err := c.batch(api+"/batch", in)
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		return nil
+	}
+	if *method == "list" {
+		if *key != "" || *value != "" {
+			return fmt.Errorf("using 'list' method with key or value is not possible")
+		}
+		params := url.Values{}
+		params.Set("prefix", *prefix)
+		if *limit > 0 {
+			params.Set("limit", strconv.Itoa(*limit))
+		}
+		if *values {
+			params.Set("values", "true")
+		}
+		c := client{log: log, token: *token, http: httpClient}
+		out, err := c.list(fmt.Sprintf("%s/keys?%s", api, params.Encode()))
+		if err != nil {
+			return err
+		}
+		for _, line := range out {
+			fmt.Println(line)
+		}
+		return nil
+	}
 	if *key == "" {
 		return fmt.Errorf("using any method without a key is not valid")
 	}
+	// the key is escaped as a single path segment, so keys with slashes or dots keep their meaning
+	dbURL := fmt.Sprintf("%s/keys/%s", api, url.PathEscape(*key))
+	// writes is true for the methods that write a value, the atomic operations are sent as a PATCH with the op
+	_, patch := patchOps[*method]
+	writes := *method == "put" || patch
 	params := url.Values{}
-	params.Set("key", *key)
-	dbURL := fmt.Sprintf("%s/db?%s", *host, params.Encode())
-	c := client{log: log}
+	if *ttl != "" {
+		if !writes {
+			return fmt.Errorf("using 'ttl' is only possible with 'put', 'append', 'incr' or 'getset' method")
+		}
+		params.Set("ttl", *ttl)
+	}
+	if patch {
+		params.Set("op", *method)
+	}
+	if *by != 1 {
+		if *method != "incr" {
+			return fmt.Errorf("using 'by' is only possible with 'incr' method")
+		}
+		params.Set("by", strconv.FormatInt(*by, 10))
+	}
+	if len(params) > 0 {
+		dbURL += "?" + params.Encode()
+	}
+	if (*ifMatch != "" || *ifNoneMatch != "") && !writes && *method != "delete" {
+		return fmt.Errorf("using 'if-match' or 'if-none-match' is only possible with 'put', 'append', 'incr', 'getset' or 'delete' method")
+	}
+	if *printETag && !writes {
+		return fmt.Errorf("using 'print-etag' is only possible with 'put', 'append', 'incr' or 'getset' method")
+	}
+	hasBody := *method == "put" || *method == "append" || *method == "getset"
+	if *file != "" && !hasBody {
+		return fmt.Errorf("using 'file' is only possible with 'put', 'append' or 'getset' method")
+	}
+	if *out != "" && *method != "get" {
+		return fmt.Errorf("using 'out' is only possible with 'get' method")
+	}
+	if (*contentType != "" || *contentEncoding != "") && !hasBody {
+		return fmt.Errorf("using 'content-type' or 'content-encoding' is only possible with 'put', 'append' or 'getset' method")
+	}
+	c := client{log: log, token: *token, http: httpClient, ifMatch: *ifMatch, ifNoneMatch: *ifNoneMatch, contentType: *contentType, contentEncoding: *contentEncoding}
 	switch *method {
 	case "delete":
 		if *value != "" {
@@ -67,28 +242,104 @@ func run(args []string, log *slog.Logger) error {
 		}
 		fmt.Println(out)
 		return nil
+	case "exists":
+		if *value != "" {
+			return fmt.Errorf("using 'exists' method with value is not possible")
+		}
+		ok, err := c.exists(dbURL)
+		if err != nil {
+			return err
+		}
+		fmt.Println(ok)
+		return nil
+	case "stat":
+		if *value != "" {
+			return fmt.Errorf("using 'stat' method with value is not possible")
+		}
+		lines, err := c.stat(dbURL)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return nil
 	case "get":
 		if *value != "" {
 			return fmt.Errorf("using 'get' method with value is not possible")
 		}
-		out, err := c.get(dbURL)
+		v, err := c.get(dbURL)
 		if err != nil {
 			return err
 		}
-		fmt.Println(out)
+		if *out != "" {
+			return os.WriteFile(*out, []byte(v), 0o644) //nolint:gosec
+		}
+		fmt.Println(v)
+		return nil
+	case "incr":
+		if *value != "" {
+			return fmt.Errorf("using 'incr' method with value is not possible, use 'by'")
+		}
+		res, err := c.patch(dbURL, "")
+		if err != nil {
+			return err
+		}
+		fmt.Println(res)
+		if *printETag {
+			fmt.Println(c.etag)
+		}
+		return nil
+	case "append", "getset":
+		if *value != "" && *file != "" {
+			return fmt.Errorf("using '%s' method with value and file is not possible", *method)
+		}
+		v := *value
+		if *file != "" {
+			b, err := readFile(*file)
+			if err != nil {
+				return err
+			}
+			v = string(b)
+		}
+		res, err := c.patch(dbURL, v)
+		if err != nil {
+			return err
+		}
+		fmt.Println(res)
+		if *printETag {
+			fmt.Println(c.etag)
+		}
 		return nil
 	case "put":
-		if *value == "" {
+		if *value != "" && *file != "" {
+			return fmt.Errorf("using 'put' method with value and file is not possible")
+		}
+		v := *value
+		if *file != "" {
+			b, err := readFile(*file)
+			if err != nil {
+				return err
+			}
+			v = string(b)
+			if c.contentType == "" {
+				c.contentType = detectContentType(*file, b)
+			}
+		}
+		if v == "" && *file == "" {
 			return fmt.Errorf("using 'put' method without value is not possible")
 		}
-		out, err := c.put(dbURL, *value)
+		res, err := c.put(dbURL, v)
 		if err != nil {
 			return err
 		}
-		fmt.Println(out)
+		fmt.Println(res)
+		if *printETag {
+			fmt.Println(c.etag)
+		}
 		return nil
 	default:
-		return fmt.Errorf("use either 'delete', 'get' or 'put' method")
+		return fmt.Errorf("use either 'append', 'batch', 'delete', 'exists', 'get', 'getset', 'incr', 'list', 'put', 'stat' or 'watch' method")
 	}
 }
 
@@ -97,27 +348,50 @@ func (c *client) delete(url string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	c.setPreconditions(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	if err = checkRespOK(resp.StatusCode); err != nil {
+	if err = checkResp(resp); err != nil {
 		c.log.Info(strconv.Itoa(resp.StatusCode))
 		return "", err
 	}
 	return "deleted", nil
 }
 
+// readFile reads the file at path, - reads from stdin.
+func readFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// detectContentType returns the media type of a file from its extension or, if unknown, its content.
+func detectContentType(path string, data []byte) string {
+	if typ := mime.TypeByExtension(filepath.Ext(path)); typ != "" {
+		return typ
+	}
+	return http.DetectContentType(data)
+}
+
+// get returns the value of url as stored, values with a Content-Encoding are not decoded.
 func (c *client) get(url string) (string, error) {
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	// any encoding is fine, this also stops the transport from decoding gzip
+	req.Header.Set("Accept-Encoding", "*")
+	resp, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
-	if err = checkRespOK(resp.StatusCode); err != nil {
+	if err = checkResp(resp); err != nil {
 		c.log.Info(strconv.Itoa(resp.StatusCode))
 		return "", err
 	}
@@ -128,26 +402,87 @@ func (c *client) get(url string) (string, error) {
 	return string(b), nil
 }
 
+// head sends a HEAD request for the entry of url and returns the headers of the response.
+func (c *client) head(url string) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = checkResp(resp); err != nil {
+		c.log.Info(strconv.Itoa(resp.StatusCode))
+		return nil, err
+	}
+	return resp.Header, nil
+}
+
+// exists reports if the key of url exists without fetching its value.
+func (c *client) exists(url string) (bool, error) {
+	_, err := c.head(url)
+	var reqErr *requestError
+	if errors.As(err, &reqErr) && reqErr.code == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// statHeaders are the metadata headers of an entry printed by stat, with their names.
+var statHeaders = [][2]string{ //nolint:gochecknoglobals
+	{"size", "Content-Length"},
+	{"etag", "ETag"},
+	{"content-type", "Content-Type"},
+	{"content-encoding", "Content-Encoding"},
+	{"revision", "X-Mod-Revision"},
+	{"create-revision", "X-Create-Revision"},
+	{"modified", "X-Mod-Time"},
+	{"created", "X-Create-Time"},
+}
+
+// stat returns the metadata of the entry of url, one line per field with the name and value separated by a tab.
+// Fields the server didn't send, like the times of old entries, are left out.
+func (c *client) stat(url string) ([]string, error) {
+	h, err := c.head(url)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, f := range statHeaders {
+		if v := h.Get(f[1]); v != "" {
+			lines = append(lines, f[0]+"\t"+v)
+		}
+	}
+	return lines, nil
+}
+
 func (c *client) put(url string, value string) (string, error) {
 	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer([]byte(value)))
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Content-Type", "text/html")
-	if err != nil {
-		return "", err
+	contentType := c.contentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	req.Header.Set("Content-Type", contentType)
+	if c.contentEncoding != "" {
+		req.Header.Set("Content-Encoding", c.contentEncoding)
+	}
+	c.setPreconditions(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	if err = checkRespOK(resp.StatusCode); err != nil {
+	if err = checkResp(resp); err != nil {
 		c.log.Info(strconv.Itoa(resp.StatusCode))
 		return "", err
 	}
+	c.etag = resp.Header.Get("ETag")
 	if resp.StatusCode == http.StatusCreated {
 		return "created", nil
 	} else {
@@ -155,11 +490,271 @@ func (c *client) put(url string, value string) (string, error) {
 	}
 }
 
+// patchOps are the methods of the client that are atomic operations of the server.
+var patchOps = map[string]struct{}{"append": {}, "incr": {}, "getset": {}} //nolint:gochecknoglobals
+
+// patch sends an atomic operation, the op is part of url, and returns the resulting value:
+// the new value, or the previous value for a getset. The Content-Type is only sent if it was set,
+// so an append keeps the type of the value.
+func (c *client) patch(url string, value string) (string, error) {
+	req, err := http.NewRequest(http.MethodPatch, url, strings.NewReader(value))
+	if err != nil {
+		return "", err
+	}
+	if c.contentType != "" {
+		req.Header.Set("Content-Type", c.contentType)
+	}
+	if c.contentEncoding != "" {
+		req.Header.Set("Content-Encoding", c.contentEncoding)
+	}
+	req.Header.Set("Accept-Encoding", "*")
+	c.setPreconditions(req)
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err = checkResp(resp); err != nil {
+		c.log.Info(strconv.Itoa(resp.StatusCode))
+		return "", err
+	}
+	c.etag = resp.Header.Get("ETag")
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// batch sends the operations read from r in one request and returns the results,
+// a JSON array for an array of operations and one result per line otherwise.
+func (c *client) batch(url string, r io.Reader) (string, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	contentType := "application/x-ndjson"
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		contentType = "application/json"
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err = checkResp(resp); err != nil {
+		c.log.Info(strconv.Itoa(resp.StatusCode))
+		return "", err
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type watchEvent struct {
+	Key      string  `json:"key"`
+	Value    *string `json:"value"`
+	Encoding string  `json:"encoding"`
+	Revision uint64  `json:"revision"`
+}
+
+// decodeValue returns the value of a JSON body as stored, base64 encoded values are decoded.
+func decodeValue(value string, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case encodingBase64:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 value: %w", err)
+		}
+		return string(b), nil
+	}
+	return "", fmt.Errorf("unknown value encoding %q", encoding)
+}
+
+// watch prints a line per change until the server ends the stream:
+// the revision, the operation, the key and for puts the value, separated by tabs.
+func (c *client) watch(url string, out io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = checkResp(resp); err != nil {
+		c.log.Info(strconv.Itoa(resp.StatusCode))
+		return err
+	}
+	sc := bufio.NewScanner(resp.Body)
+	var event, data string
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			var ev watchEvent
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				return err
+			}
+			fields := []string{strconv.FormatUint(ev.Revision, 10), event, ev.Key}
+			if ev.Value != nil {
+				value, err := decodeValue(*ev.Value, ev.Encoding)
+				if err != nil {
+					return err
+				}
+				fields = append(fields, value)
+			}
+			fmt.Fprintln(out, strings.Join(fields, "\t"))
+			event, data = "", ""
+		}
+	}
+	return sc.Err()
+}
+
+type listItem struct {
+	Key      string  `json:"key"`
+	Value    *string `json:"value"`
+	Encoding string  `json:"encoding"`
+}
+
+type listResponse struct {
+	Keys   []listItem `json:"keys"`
+	Cursor string     `json:"cursor"`
+}
+
+// list follows the cursor until all keys are fetched and returns one line per key,
+// the key and its value are separated by a tab if values were requested.
+func (c *client) list(url string) ([]string, error) {
+	var lines []string
+	cursor := ""
+	for {
+		pageURL := url
+		if cursor != "" {
+			pageURL += "&cursor=" + cursor
+		}
+		req, err := http.NewRequest(http.MethodGet, pageURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page listResponse
+		err = checkResp(resp)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		} else {
+			c.log.Info(strconv.Itoa(resp.StatusCode))
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Keys {
+			if item.Value != nil {
+				value, err := decodeValue(*item.Value, item.Encoding)
+				if err != nil {
+					return nil, err
+				}
+				lines = append(lines, item.Key+"\t"+value)
+			} else {
+				lines = append(lines, item.Key)
+			}
+		}
+		if page.Cursor == "" {
+			return lines, nil
+		}
+		cursor = page.Cursor
+	}
+}
+
+// do sends req with the bearer token of the client, if it has one.
+func (c *client) do(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.http != nil {
+		return c.http.Do(req)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// newHTTPClient returns a client that trusts the CAs of the caFile bundle and sends the client certificate,
+// without any of them it returns nil, so http.DefaultClient is used.
+func newHTTPClient(caFile string, certFile string, keyFile string) (*http.Client, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("the CA bundle %s has no PEM certificates", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("using 'tls-cert' or 'tls-key' is only possible with both")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: cfg}}, nil
+}
+
+func (c *client) setPreconditions(req *http.Request) {
+	if c.ifMatch != "" {
+		req.Header.Set("If-Match", c.ifMatch)
+	}
+	if c.ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", c.ifNoneMatch)
+	}
+}
+
 func checkRespOK(code int) error {
 	switch code {
 	case http.StatusOK, http.StatusCreated:
 		return nil
 	default:
-		return &requestError{code}
+		return &requestError{code: code}
+	}
+}
+
+// checkResp is checkRespOK for a whole response, the error includes the problem document of the body.
+func checkResp(resp *http.Response) error {
+	err := checkRespOK(resp.StatusCode)
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		return err
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/problem+json" {
+		return err
+	}
+	var p problem
+	if json.NewDecoder(resp.Body).Decode(&p) == nil {
+		reqErr.problem = &p
 	}
+	return reqErr
 }
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jarcoal/httpmock"
 	"github.com/matryer/is"
@@ -44,7 +59,7 @@ func TestDelete(t *testing.T) {
 			c := client{log: slog.New(slog.NewJSONHandler(os.Stderr, nil))}
 			out, err := c.delete(dbURL)
 			if tt.isErr {
-				reqErro := requestError{tt.code}
+				reqErro := requestError{code: tt.code}
 				is.Equal(reqErro.Error(), err.Error())
 			} else {
 				is.NoErr(err)
@@ -185,7 +200,7 @@ func TestRunDelete(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	httpmock.RegisterResponder(http.MethodDelete, "http://test.com/db?key=test",
+	httpmock.RegisterResponder(http.MethodDelete, "http://test.com/v1/keys/test",
 		httpmock.NewStringResponder(200, `test-value`))
 
 	err := run([]string{"test", "-host", "http://test.com", "-m", "delete", "-key", "test"}, logger)
@@ -199,7 +214,7 @@ func TestRunGet(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	httpmock.RegisterResponder(http.MethodGet, "http://test.com/db?key=test",
+	httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/keys/test",
 		httpmock.NewStringResponder(200, ``))
 
 	err := run([]string{"test", "-host", "http://test.com", "-m", "get", "-key", "test"}, logger)
@@ -213,9 +228,473 @@ func TestRunPut(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	httpmock.RegisterResponder(http.MethodPut, "http://test.com/db?key=test",
+	httpmock.RegisterResponder(http.MethodPut, "http://test.com/v1/keys/test",
 		httpmock.NewStringResponder(201, `new-value`))
 
 	err := run([]string{"test", "-host", "http://test.com", "-m", "put", "-key", "test", "-value", "new-value"}, logger)
 	is.NoErr(err)
 }
+
+func TestPutIfMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch string
+		isErr   bool
+	}{
+		{name: "current etag", ifMatch: `"2"`, isErr: false},
+		{name: "stale etag", ifMatch: `"1"`, isErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			httpmock.Activate()
+			defer httpmock.DeactivateAndReset()
+
+			httpmock.RegisterResponder(http.MethodPut, "http://test.com/db?key=test",
+				func(req *http.Request) (*http.Response, error) {
+					if req.Header.Get("If-Match") != `"2"` {
+						return httpmock.NewStringResponse(http.StatusPreconditionFailed, ``), nil
+					}
+					resp := httpmock.NewStringResponse(http.StatusOK, ``)
+					resp.Header.Set("ETag", `"3"`)
+					return resp, nil
+				})
+
+			c := client{log: slog.New(slog.NewJSONHandler(os.Stderr, nil)), ifMatch: tt.ifMatch}
+			out, err := c.put("http://test.com/db?key=test", "value")
+			if tt.isErr {
+				is.Equal(err, &requestError{code: http.StatusPreconditionFailed})
+			} else {
+				is.NoErr(err)
+				is.Equal(out, "updated")
+				is.Equal(c.etag, `"3"`)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	is := is.New(t)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/keys?prefix=a&values=true",
+		httpmock.NewStringResponder(http.StatusOK, `{"keys":[{"key":"a","value":"1"},{"key":"ab","value":""}],"cursor":"YWM"}`))
+	httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/keys?prefix=a&values=true&cursor=YWM",
+		httpmock.NewStringResponder(http.StatusOK, `{"keys":[{"key":"ac","value":"3"},{"key":"ad","value":"//4A","encoding":"base64"}]}`))
+
+	c := client{log: slog.New(slog.NewJSONHandler(os.Stderr, nil))}
+	out, err := c.list("http://test.com/v1/keys?prefix=a&values=true")
+	is.NoErr(err)
+	// binary values are decoded
+	is.Equal(out, []string{"a\t1", "ab\t", "ac\t3", "ad\t\xff\xfe\x00"})
+}
+
+func TestRunList(t *testing.T) {
+	is := is.New(t)
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{AddSource: true}))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/keys?limit=10&prefix=a",
+		httpmock.NewStringResponder(http.StatusOK, `{"keys":[{"key":"a"}]}`))
+
+	err := run([]string{"test", "-host", "http://test.com", "-m", "list", "-prefix", "a", "-limit", "10"}, logger)
+	is.NoErr(err)
+	err = run([]string{"test", "-host", "http://test.com", "-m", "list", "-key", "a"}, logger)
+	is.True(err != nil)
+}
+
+func TestBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		ops         string
+		contentType string
+	}{
+		{name: "json", ops: ` [{"op":"get","key":"a"}]`, contentType: "application/json"},
+		{name: "ndjson", ops: "{\"op\":\"get\",\"key\":\"a\"}\n", contentType: "application/x-ndjson"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			httpmock.Activate()
+			defer httpmock.DeactivateAndReset()
+
+			httpmock.RegisterResponder(http.MethodPost, "http://test.com/v1/batch",
+				func(req *http.Request) (*http.Response, error) {
+					is.Equal(req.Header.Get("Content-Type"), tt.contentType)
+					return httpmock.NewStringResponse(http.StatusOK, `{"status":200,"value":"1"}`+"\n"), nil
+				})
+
+			c := client{log: slog.New(slog.NewJSONHandler(os.Stderr, nil))}
+			out, err := c.batch("http://test.com/v1/batch", strings.NewReader(tt.ops))
+			is.NoErr(err)
+			is.Equal(out, `{"status":200,"value":"1"}`+"\n")
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	is := is.New(t)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/watch?prefix=a&rev=3",
+		httpmock.NewStringResponder(http.StatusOK, "id: 3\nevent: put\ndata: {\"key\":\"a\",\"value\":\"1\",\"revision\":3}\n\n"+
+			": heartbeat\n\n"+
+			"id: 4\nevent: delete\ndata: {\"key\":\"ab\",\"revision\":4}\n\n"+
+			"id: 5\nevent: put\ndata: {\"key\":\"ac\",\"value\":\"//4A\",\"encoding\":\"base64\",\"revision\":5}\n\n"))
+
+	var out bytes.Buffer
+	c := client{log: slog.New(slog.NewJSONHandler(os.Stderr, nil))}
+	is.NoErr(c.watch("http://test.com/v1/watch?prefix=a&rev=3", &out))
+	is.Equal(out.String(), "3\tput\ta\t1\n4\tdelete\tab\n5\tput\tac\t\xff\xfe\x00\n")
+}
+
+func TestRunPutFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		args        []string
+		contentType string
+		encoding    string
+	}{
+		{name: "extension", file: "value.json", contentType: "application/json"},
+		{name: "sniffed", file: "value", contentType: "application/octet-stream"},
+		{name: "explicit", file: "value.gz", args: []string{"-content-type", "text/csv", "-content-encoding", "gzip"}, contentType: "text/csv", encoding: "gzip"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			data := "\x1f\x8b\x00\xff"
+			path := filepath.Join(t.TempDir(), tt.file)
+			is.NoErr(os.WriteFile(path, []byte(data), 0o600))
+
+			httpmock.Activate()
+			defer httpmock.DeactivateAndReset()
+			httpmock.RegisterResponder(http.MethodPut, "http://test.com/v1/keys/test",
+				func(req *http.Request) (*http.Response, error) {
+					body, err := io.ReadAll(req.Body)
+					is.NoErr(err)
+					is.Equal(string(body), data)
+					is.Equal(req.Header.Get("Content-Type"), tt.contentType)
+					is.Equal(req.Header.Get("Content-Encoding"), tt.encoding)
+					return httpmock.NewStringResponse(http.StatusCreated, ""), nil
+				})
+
+			args := append([]string{"test", "-host", "http://test.com", "-m", "put", "-key", "test", "-file", path}, tt.args...)
+			is.NoErr(run(args, logger))
+		})
+	}
+}
+
+func TestRunGetOut(t *testing.T) {
+	is := is.New(t)
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	data := "\x1f\x8b\x00\xff"
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/keys/test",
+		func(req *http.Request) (*http.Response, error) {
+			resp := httpmock.NewStringResponse(http.StatusOK, data)
+			resp.Header.Set("Content-Encoding", "gzip")
+			return resp, nil
+		})
+
+	path := filepath.Join(t.TempDir(), "out")
+	is.NoErr(run([]string{"test", "-host", "http://test.com", "-m", "get", "-key", "test", "-out", path}, logger))
+	b, err := os.ReadFile(path)
+	is.NoErr(err)
+	// the value is written as stored, it isn't decoded
+	is.Equal(string(b), data)
+}
+
+func TestRunKeyPath(t *testing.T) {
+	is := is.New(t)
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder(http.MethodPut, "http://test.com/v1/keys/a%2F..%2Fb?ttl=1m",
+		func(req *http.Request) (*http.Response, error) {
+			// the key is a single escaped segment, so the server doesn't clean it
+			is.Equal(req.URL.EscapedPath(), "/v1/keys/a%2F..%2Fb")
+			return httpmock.NewStringResponse(http.StatusCreated, ""), nil
+		})
+
+	is.NoErr(run([]string{"test", "-host", "http://test.com", "-m", "put", "-key", "a/../b", "-value", "1", "-ttl", "1m"}, logger))
+}
+
+func TestRunNamespace(t *testing.T) {
+	is := is.New(t)
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder(http.MethodPut, "http://test.com/v1/ns/team/keys/a",
+		httpmock.NewStringResponder(http.StatusCreated, ""))
+	httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/ns/team/keys?prefix=a",
+		httpmock.NewStringResponder(http.StatusOK, `{"keys":[{"key":"a"}]}`))
+	httpmock.RegisterResponder(http.MethodPost, "http://test.com/v1/ns/team/batch",
+		httpmock.NewStringResponder(http.StatusOK, `[]`))
+
+	is.NoErr(run([]string{"test", "-host", "http://test.com", "-ns", "team", "-m", "put", "-key", "a", "-value", "1"}, logger))
+	is.NoErr(run([]string{"test", "-host", "http://test.com", "-ns", "team", "-m", "list", "-prefix", "a"}, logger))
+	ops := filepath.Join(t.TempDir(), "ops.json")
+	is.NoErr(os.WriteFile(ops, []byte(`[{"op":"get","key":"a"}]`), 0o600))
+	is.NoErr(run([]string{"test", "-host", "http://test.com", "-ns", "team", "-m", "batch", "-ops", ops}, logger))
+	is.Equal(httpmock.GetTotalCallCount(), 3)
+}
+
+func TestRunToken(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want string
+	}{
+		{name: "flag", args: []string{"-token", "secret"}, want: "Bearer secret"},
+		{name: "env", env: "from-env", want: "Bearer from-env"},
+		{name: "flag overrides env", env: "from-env", args: []string{"-token", "secret"}, want: "Bearer secret"},
+		{name: "none", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			t.Setenv(envToken, tt.env)
+
+			httpmock.Activate()
+			defer httpmock.DeactivateAndReset()
+			var got []string
+			record := func(code int, body string) httpmock.Responder {
+				return func(req *http.Request) (*http.Response, error) {
+					got = append(got, req.Header.Get("Authorization"))
+					return httpmock.NewStringResponse(code, body), nil
+				}
+			}
+			httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/keys/a", record(http.StatusOK, "1"))
+			httpmock.RegisterResponder(http.MethodHead, "http://test.com/v1/keys/a", record(http.StatusOK, ""))
+			httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/keys?prefix=", record(http.StatusOK, `{"keys":[]}`))
+
+			for _, args := range [][]string{
+				{"-m", "get", "-key", "a"},
+				{"-m", "exists", "-key", "a"},
+				{"-m", "list"},
+			} {
+				args = append(append([]string{"test", "-host", "http://test.com"}, tt.args...), args...)
+				is.NoErr(run(args, logger))
+			}
+			is.Equal(got, []string{tt.want, tt.want, tt.want}) // every request carries the token
+		})
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	is := is.New(t)
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder(http.MethodGet, "http://test.com/v1/keys/a",
+		httpmock.NewStringResponder(http.StatusUnauthorized,
+			`{"type":"about:blank","title":"Unauthorized","status":401,"detail":"error: the request has no bearer token","code":"unauthorized"}`).
+			HeaderSet(http.Header{"Content-Type": {"application/problem+json"}}))
+
+	err := run([]string{"test", "-host", "http://test.com", "-m", "get", "-key", "a"}, logger)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "(unauthorized): the request has no bearer token"))
+}
+
+func TestProblemError(t *testing.T) {
+	is := is.New(t)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodPut, "http://test.com/v1/keys/test",
+		func(req *http.Request) (*http.Response, error) {
+			resp := httpmock.NewStringResponse(http.StatusRequestEntityTooLarge,
+				`{"type":"about:blank","title":"Request Entity Too Large","status":413,"detail":"error: key is too long","code":"key_too_long","limit":20}`)
+			resp.Header.Set("Content-Type", "application/problem+json")
+			return resp, nil
+		})
+
+	c := client{log: slog.New(slog.NewJSONHandler(os.Stderr, nil))}
+	_, err := c.put("http://test.com/v1/keys/test", "value")
+	var reqErr *requestError
+	is.True(errors.As(err, &reqErr))
+	is.Equal(reqErr.code, http.StatusRequestEntityTooLarge)
+	is.Equal(reqErr.problem.Code, "key_too_long")
+	is.Equal(err.Error(), "the request returned with http code: 413 (key_too_long): key is too long, the limit is 20")
+}
+
+func TestExists(t *testing.T) {
+	is := is.New(t)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodHead, "http://test.com/v1/keys/a", httpmock.NewStringResponder(http.StatusOK, ""))
+	httpmock.RegisterResponder(http.MethodHead, "http://test.com/v1/keys/missing", httpmock.NewStringResponder(http.StatusNotFound, ""))
+	httpmock.RegisterResponder(http.MethodHead, "http://test.com/v1/keys/broken", httpmock.NewStringResponder(http.StatusInternalServerError, ""))
+
+	c := client{log: slog.New(slog.NewJSONHandler(os.Stderr, nil))}
+	ok, err := c.exists("http://test.com/v1/keys/a")
+	is.NoErr(err)
+	is.True(ok)
+	ok, err = c.exists("http://test.com/v1/keys/missing")
+	is.NoErr(err)
+	is.True(!ok)
+	_, err = c.exists("http://test.com/v1/keys/broken")
+	is.True(err != nil)
+}
+
+func TestStat(t *testing.T) {
+	is := is.New(t)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodHead, "http://test.com/v1/keys/a",
+		func(req *http.Request) (*http.Response, error) {
+			resp := httpmock.NewStringResponse(http.StatusOK, "")
+			resp.Header.Set("Content-Length", "5")
+			resp.Header.Set("ETag", `"4"`)
+			resp.Header.Set("Content-Type", "text/plain")
+			resp.Header.Set("X-Mod-Revision", "4")
+			resp.Header.Set("X-Create-Revision", "1")
+			resp.Header.Set("X-Mod-Time", "2023-05-01T10:00:00Z")
+			return resp, nil
+		})
+
+	c := client{log: slog.New(slog.NewJSONHandler(os.Stderr, nil))}
+	out, err := c.stat("http://test.com/v1/keys/a")
+	is.NoErr(err)
+	is.Equal(out, []string{
+		"size\t5", "etag\t\"4\"", "content-type\ttext/plain", "revision\t4", "create-revision\t1", "modified\t2023-05-01T10:00:00Z",
+	})
+}
+
+func TestPatch(t *testing.T) {
+	is := is.New(t)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodPatch, "http://test.com/v1/keys/log?op=append",
+		func(req *http.Request) (*http.Response, error) {
+			b, err := io.ReadAll(req.Body)
+			is.NoErr(err)
+			is.Equal(string(b), "c")
+			// the stored type is kept
+			is.Equal(req.Header.Get("Content-Type"), "")
+			resp := httpmock.NewStringResponse(http.StatusOK, "abc")
+			resp.Header.Set("ETag", `"3"`)
+			return resp, nil
+		})
+
+	c := client{log: slog.New(slog.NewJSONHandler(os.Stderr, nil))}
+	out, err := c.patch("http://test.com/v1/keys/log?op=append", "c")
+	is.NoErr(err)
+	is.Equal(out, "abc")
+	is.Equal(c.etag, `"3"`)
+}
+
+func TestRunPatch(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	tests := []struct {
+		name  string
+		args  []string
+		query string
+		isErr bool
+	}{
+		{name: "incr", args: []string{"-m", "incr", "-key", "n"}, query: "op=incr"},
+		{name: "decr", args: []string{"-m", "incr", "-key", "n", "-by", "-2", "-ttl", "1m"}, query: "by=-2&op=incr&ttl=1m"},
+		{name: "append", args: []string{"-m", "append", "-key", "n", "-value", "x"}, query: "op=append"},
+		{name: "getset", args: []string{"-m", "getset", "-key", "n", "-value", "x"}, query: "op=getset"},
+		{name: "by without incr", args: []string{"-m", "append", "-key", "n", "-by", "2"}, isErr: true},
+		{name: "incr with value", args: []string{"-m", "incr", "-key", "n", "-value", "2"}, isErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			httpmock.Activate()
+			defer httpmock.DeactivateAndReset()
+			httpmock.RegisterResponder(http.MethodPatch, "http://test.com/v1/keys/n?"+tt.query,
+				httpmock.NewStringResponder(http.StatusOK, "1"))
+
+			err := run(append([]string{"test", "-host", "http://test.com"}, tt.args...), logger)
+			if tt.isErr {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(httpmock.GetTotalCallCount(), 1)
+		})
+	}
+}
+
+// writeCert writes a certificate for 127.0.0.1 signed by parent and its key to dir, without a parent it's a self-signed CA.
+func writeCert(t *testing.T, dir string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	is := is.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "rampu"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		tmpl.KeyUsage, tmpl.IsCA, tmpl.BasicConstraintsValid = x509.KeyUsageCertSign, true, true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	is.NoErr(err)
+	cert, err := x509.ParseCertificate(der)
+	is.NoErr(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	is.NoErr(err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	is.NoErr(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	is.NoErr(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return cert, key, certFile, keyFile
+}
+
+func TestRunTLS(t *testing.T) {
+	is := is.New(t)
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	ca, caKey, caFile, _ := writeCert(t, t.TempDir(), nil, nil)
+	_, _, serverCert, serverKey := writeCert(t, t.TempDir(), ca, caKey)
+	_, _, clientCert, clientKey := writeCert(t, t.TempDir(), ca, caKey)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.Equal(r.URL.Path, "/v1/keys/a")
+		fmt.Fprint(w, "1")
+	}))
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	is.NoErr(err)
+	srv.TLS = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    x509.NewCertPool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.TLS.ClientCAs.AddCert(ca)
+	srv.StartTLS()
+	defer srv.Close()
+
+	args := []string{"test", "-host", srv.URL, "-m", "get", "-key", "a"}
+	is.NoErr(run(append(args, "-tls-ca", caFile, "-tls-cert", clientCert, "-tls-key", clientKey), logger))
+	is.True(run(append(args, "-tls-ca", caFile), logger) != nil)                                                    // the server requires a client certificate
+	is.True(run(append(args, "-tls-cert", clientCert, "-tls-key", clientKey), logger) != nil)                       // the server isn't trusted
+	is.True(run(append(args, "-tls-ca", caFile, "-tls-cert", clientCert), logger) != nil)                           // the key is missing
+	is.True(run(append(args, "-tls-ca", clientKey, "-tls-cert", clientCert, "-tls-key", clientKey), logger) != nil) // no CA certificates
+}
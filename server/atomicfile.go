@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeFileAtomic replaces the file at path with the output of write.
+// The data is written to a temp file in the same directory, synced and renamed over path,
+// so path always holds either the old or the new content, even if the process crashes mid-write.
+// Up to backups previous versions are kept as path.1 (newest) to path.<backups> (oldest).
+func writeFileAtomic(path string, backups int, write func(w io.Writer) error) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, base+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("can't create temp file: %w", err)
+	}
+	// removing the temp file fails once it has been renamed, which is fine
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(filePerm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't set file mode: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("can't close temp file: %w", err)
+	}
+	if err := rotateBackups(path, backups); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("can't replace file: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// removeTempFiles removes the temp files writeFileAtomic left next to path when the process crashed mid-write.
+func removeTempFiles(path string) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read directory: %w", err)
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), base+".tmp-") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+			return fmt.Errorf("can't remove temp file: %w", err)
+		}
+	}
+	return nil
+}
+
+// rotateBackups shifts path.1 ... path.<backups-1> up by one and hard links path to path.1.
+// Linking instead of renaming keeps path in place until the new version is renamed over it.
+func rotateBackups(path string, backups int) error {
+	if backups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	for i := backups - 1; i >= 1; i-- {
+		err := os.Rename(backupPath(path, i), backupPath(path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("can't rotate backup: %w", err)
+		}
+	}
+	newest := backupPath(path, 1)
+	if err := os.Remove(newest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("can't remove backup: %w", err)
+	}
+	if err := os.Link(path, newest); err != nil {
+		return fmt.Errorf("can't create backup: %w", err)
+	}
+	return nil
+}
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("can't open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("can't sync directory: %w", err)
+	}
+	return nil
+}
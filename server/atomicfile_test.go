@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/exp/slog"
+)
+
+var errDiskFull = errors.New("no space left on device")
+
+func TestWriteFileAtomicPartialWrite(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.snap")
+	is.NoErr(os.WriteFile(path, []byte("old"), filePerm))
+
+	// the writer dies halfway through like on a full disk
+	err := writeFileAtomic(path, 1, func(w io.Writer) error {
+		if _, err := w.Write([]byte("ne")); err != nil {
+			return err
+		}
+		return errDiskFull
+	})
+	is.True(errors.Is(err, errDiskFull))
+
+	b, err := os.ReadFile(path)
+	is.NoErr(err)
+	is.Equal(string(b), "old")
+	files, err := os.ReadDir(dir)
+	is.NoErr(err)
+	is.Equal(len(files), 1) // temp file is cleaned up and no backup was made
+}
+
+func TestPersistIgnoresStaleTempFile(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.snap")
+	db := newDatabase(path, defaultLimits())
+	_, _, err := db.put("a", "1", putOptions{})
+	is.NoErr(err)
+	is.NoErr(db.persist())
+
+	// a crash mid-write leaves a truncated temp file next to the snapshot
+	is.NoErr(os.WriteFile(path+".tmp-123", []byte("RKV"), filePerm))
+
+	restored, err := loadDatabase(path, defaultLimits())
+	is.NoErr(err)
+	is.Equal(restored.db, db.db)
+}
+
+func TestWriteFileAtomicBackups(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.snap")
+	for _, content := range []string{"1", "2", "3", "4"} {
+		content := content
+		is.NoErr(writeFileAtomic(path, 2, func(w io.Writer) error {
+			_, err := w.Write([]byte(content))
+			return err
+		}))
+	}
+
+	for file, want := range map[string]string{path: "4", backupPath(path, 1): "3", backupPath(path, 2): "2"} {
+		b, err := os.ReadFile(file)
+		is.NoErr(err)
+		is.Equal(string(b), want)
+	}
+	_, err := os.Stat(backupPath(path, 3))
+	is.True(errors.Is(err, os.ErrNotExist))
+}
+
+func TestOpenDatabaseRemovesTempFiles(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.snap")
+	db := newDatabase(path, defaultLimits())
+	_, _, err := db.put("a", "1", putOptions{})
+	is.NoErr(err)
+	is.NoErr(db.persist())
+	// crashes mid-write leave temp files next to the snapshot
+	for _, name := range []string{"database.snap.tmp-123", "database.snap.tmp-456", "other.tmp-1"} {
+		is.NoErr(os.WriteFile(filepath.Join(dir, name), []byte("RKV"), filePerm))
+	}
+
+	restored, err := openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.NoErr(err)
+	defer restored.wal.close()
+	is.Equal(len(restored.db), 1)
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmp-*"))
+	is.NoErr(err)
+	is.Equal(files, []string{filepath.Join(dir, "other.tmp-1")}) // only the temp files of the snapshot are removed
+}
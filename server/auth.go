@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// The permissions a grant gives on the keys with its prefix.
+const (
+	permRead   = "read"
+	permWrite  = "write"
+	permDelete = "delete"
+)
+
+// bearerChallenge is sent with 401 Unauthorized, so clients know to send a bearer token.
+const bearerChallenge = `Bearer realm="rampu"`
+
+var errNoToken = errors.New("error: the request has no bearer token")
+
+// UnauthorizedError is returned for a request without a valid bearer token.
+type UnauthorizedError struct {
+	err error
+}
+
+func (e *UnauthorizedError) Error() string {
+	return e.err.Error()
+}
+
+// ForbiddenError is returned for a request whose token lacks a permission on a key.
+type ForbiddenError struct {
+	name       string
+	permission string
+	key        string
+}
+
+func (e *ForbiddenError) Error() string {
+	if e.permission == "" {
+		return fmt.Sprintf("error: token \"%s\" is not an admin token", e.name)
+	}
+	return fmt.Sprintf("error: token \"%s\" may not %s key \"%s\"", e.name, e.permission, e.key)
+}
+
+// grant gives permissions on the keys starting with Prefix in Namespace, an empty namespace is the default keyspace.
+type grant struct {
+	Namespace   string   `json:"namespace,omitempty"`
+	Prefix      string   `json:"prefix"`
+	Permissions []string `json:"permissions"`
+}
+
+// tokenConfig is a token of the tokens file. Admin tokens may access all keys and manage namespaces.
+type tokenConfig struct {
+	Name   string  `json:"name"`
+	Token  string  `json:"token"`
+	Admin  bool    `json:"admin,omitempty"`
+	Grants []grant `json:"grants,omitempty"`
+}
+
+type tokensFile struct {
+	Tokens []tokenConfig `json:"tokens"`
+}
+
+// principal is the holder of a token, the requests it authenticates carry it in their context.
+type principal struct {
+	name   string
+	admin  bool
+	grants []grant
+}
+
+// allowed reports if p has the permission on key in namespace ns.
+// key may be the prefix of a list or watch, a grant must cover the whole prefix then.
+func (p *principal) allowed(ns string, key string, perm string) bool {
+	if p.admin {
+		return true
+	}
+	for _, g := range p.grants {
+		if g.Namespace != ns || !strings.HasPrefix(key, g.Prefix) {
+			continue
+		}
+		for _, gp := range g.Permissions {
+			if gp == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenHash is the key of a token, so lookups don't compare the secret itself.
+type tokenHash [sha256.Size]byte
+
+// authenticator holds the tokens of the tokens file, reload replaces them while requests are served.
+type authenticator struct {
+	path   string
+	tokens atomic.Pointer[map[tokenHash]*principal]
+}
+
+// loadAuthenticator reads the tokens from the JSON file at path, e.g.
+// {"tokens": [{"name": "ci", "token": "...", "grants": [{"prefix": "config/", "permissions": ["read"]}]}]}.
+func loadAuthenticator(path string) (*authenticator, error) {
+	a := &authenticator{path: path}
+	if _, err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload reads the tokens file again and returns the number of tokens.
+// An invalid file keeps the previous tokens.
+func (a *authenticator) reload() (int, error) {
+	b, err := os.ReadFile(a.path)
+	if err != nil {
+		return 0, fmt.Errorf("can't read tokens: %w", err)
+	}
+	tokens, err := parseTokens(b)
+	if err != nil {
+		return 0, err
+	}
+	a.tokens.Store(&tokens)
+	return len(tokens), nil
+}
+
+func parseTokens(b []byte) (map[tokenHash]*principal, error) {
+	var f tokensFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("can't read tokens: %w", err)
+	}
+	tokens := make(map[tokenHash]*principal, len(f.Tokens))
+	names := make(map[string]struct{}, len(f.Tokens))
+	for i, t := range f.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("token %d: name and token must be set", i) //nolint:goerr113
+		}
+		if _, ok := names[t.Name]; ok {
+			return nil, fmt.Errorf("token %q: the name is used twice", t.Name) //nolint:goerr113
+		}
+		names[t.Name] = struct{}{}
+		h := sha256.Sum256([]byte(t.Token))
+		if _, ok := tokens[h]; ok {
+			return nil, fmt.Errorf("token %q: the token is used twice", t.Name) //nolint:goerr113
+		}
+		for _, g := range t.Grants {
+			for _, perm := range g.Permissions {
+				if perm != permRead && perm != permWrite && perm != permDelete {
+					return nil, fmt.Errorf("token %q: unknown permission %q, use either 'read', 'write' or 'delete'", t.Name, perm) //nolint:goerr113
+				}
+			}
+		}
+		tokens[h] = &principal{name: t.Name, admin: t.Admin, grants: t.Grants}
+	}
+	return tokens, nil
+}
+
+// authenticate returns the holder of the bearer token in the Authorization header.
+func (a *authenticator) authenticate(r *http.Request) (*principal, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, &UnauthorizedError{err: errNoToken}
+	}
+	p, ok := (*a.tokens.Load())[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, &UnauthorizedError{err: errors.New("error: the bearer token is unknown")} //nolint:goerr113
+	}
+	return p, nil
+}
+
+type principalKey struct{}
+
+// authenticated rejects requests without a valid token with 401 Unauthorized, without tokens every request is served.
+func (s *server) authenticated(hf http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			hf(w, r)
+			return
+		}
+		p, err := s.auth.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", bearerChallenge)
+			s.writeError(w, r, err)
+			return
+		}
+		hf(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// authorize checks that the token of the request has the permissions on key in the namespace of the request.
+// Requests are only unauthenticated if the server has no tokens, they may do anything then.
+func (s *server) authorize(r *http.Request, key string, perms ...string) error {
+	p, ok := r.Context().Value(principalKey{}).(*principal)
+	if !ok {
+		return nil
+	}
+	var ns string
+	if n, ok := r.Context().Value(namespaceKey{}).(*namespace); ok {
+		ns = n.name
+	}
+	for _, perm := range perms {
+		if !p.allowed(ns, key, perm) {
+			return &ForbiddenError{name: p.name, permission: perm, key: key}
+		}
+	}
+	return nil
+}
+
+// adminOnly serves the request only if its token is an admin token.
+func (s *server) adminOnly(hf http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := r.Context().Value(principalKey{}).(*principal); ok && !p.admin {
+			s.writeError(w, r, &ForbiddenError{name: p.name})
+			return
+		}
+		hf(w, r)
+	}
+}
+
+// permissionOf returns the permission an operation with the method needs.
+func permissionOf(method string) string {
+	switch method {
+	case http.MethodPut, http.MethodPatch:
+		return permWrite
+	case http.MethodDelete:
+		return permDelete
+	default:
+		return permRead
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+const testTokens = `{"tokens": [
+	{"name": "admin", "token": "admin-token", "admin": true},
+	{"name": "reader", "token": "reader-token", "grants": [{"prefix": "config/", "permissions": ["read"]}]},
+	{"name": "writer", "token": "writer-token", "grants": [
+		{"prefix": "config/", "permissions": ["read", "write"]},
+		{"namespace": "team", "prefix": "", "permissions": ["read", "write", "delete"]}
+	]}
+]}`
+
+// testAuthenticator writes tokens to a file and loads it.
+func testAuthenticator(t *testing.T, tokens string) *authenticator {
+	t.Helper()
+	is := is.New(t)
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	is.NoErr(os.WriteFile(path, []byte(tokens), 0o600))
+	a, err := loadAuthenticator(path)
+	is.NoErr(err)
+	return a
+}
+
+func TestParseTokens(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		tokens string
+		count  int
+		err    bool
+	}{
+		{name: "valid", tokens: testTokens, count: 3},
+		{name: "empty", tokens: `{"tokens": []}`, count: 0},
+		{name: "invalid json", tokens: `{"tokens": [`, err: true},
+		{name: "missing name", tokens: `{"tokens": [{"token": "a"}]}`, err: true},
+		{name: "missing token", tokens: `{"tokens": [{"name": "a"}]}`, err: true},
+		{name: "duplicate name", tokens: `{"tokens": [{"name": "a", "token": "a"}, {"name": "a", "token": "b"}]}`, err: true},
+		{name: "duplicate token", tokens: `{"tokens": [{"name": "a", "token": "a"}, {"name": "b", "token": "a"}]}`, err: true},
+		{
+			name: "unknown permission", tokens: `{"tokens": [{"name": "a", "token": "a", "grants": [{"prefix": "", "permissions": ["admin"]}]}]}`,
+			err: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			tokens, err := parseTokens([]byte(tt.tokens))
+			if tt.err {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(len(tokens), tt.count)
+		})
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		auth   string
+		code   int
+	}{
+		{name: "no token", method: http.MethodGet, path: "/v1/keys/config/a", code: http.StatusUnauthorized},
+		{name: "unknown token", method: http.MethodGet, path: "/v1/keys/config/a", auth: "Bearer nope", code: http.StatusUnauthorized},
+		{name: "basic auth", method: http.MethodGet, path: "/v1/keys/config/a", auth: "Basic cmVhZGVyLXRva2Vu", code: http.StatusUnauthorized},
+		{name: "legacy route", method: http.MethodGet, path: "/db?key=config/a", code: http.StatusUnauthorized},
+		{name: "read", method: http.MethodGet, path: "/v1/keys/config/a", auth: "Bearer reader-token", code: http.StatusOK},
+		{name: "lowercase scheme", method: http.MethodGet, path: "/v1/keys/config/a", auth: "bearer reader-token", code: http.StatusOK},
+		{name: "head", method: http.MethodHead, path: "/v1/keys/config/a", auth: "Bearer reader-token", code: http.StatusOK},
+		{name: "read outside prefix", method: http.MethodGet, path: "/v1/keys/other", auth: "Bearer reader-token", code: http.StatusForbidden},
+		{name: "write without grant", method: http.MethodPut, path: "/v1/keys/config/b", body: "1", auth: "Bearer reader-token", code: http.StatusForbidden},
+		{name: "write", method: http.MethodPut, path: "/v1/keys/config/b", body: "1", auth: "Bearer writer-token", code: http.StatusCreated},
+		{name: "delete without grant", method: http.MethodDelete, path: "/v1/keys/config/a", auth: "Bearer writer-token", code: http.StatusForbidden},
+		{name: "delete as admin", method: http.MethodDelete, path: "/v1/keys/config/a", auth: "Bearer admin-token", code: http.StatusOK},
+		{name: "patch", method: http.MethodPatch, path: "/v1/keys/config/n?op=incr", auth: "Bearer writer-token", code: http.StatusCreated},
+		{name: "patch without write", method: http.MethodPatch, path: "/v1/keys/config/n?op=incr", auth: "Bearer reader-token", code: http.StatusForbidden},
+		{name: "list", method: http.MethodGet, path: "/v1/keys?prefix=config/", auth: "Bearer reader-token", code: http.StatusOK},
+		{name: "list all", method: http.MethodGet, path: "/v1/keys", auth: "Bearer reader-token", code: http.StatusForbidden},
+		{name: "history", method: http.MethodGet, path: "/v1/history?key=config/a", auth: "Bearer reader-token", code: http.StatusOK},
+		{name: "history outside prefix", method: http.MethodGet, path: "/v1/history?key=other", auth: "Bearer reader-token", code: http.StatusForbidden},
+		{name: "watch", method: http.MethodGet, path: "/v1/watch?prefix=config/", auth: "Bearer reader-token", code: http.StatusOK},
+		{name: "watch all", method: http.MethodGet, path: "/v1/watch", auth: "Bearer reader-token", code: http.StatusForbidden},
+		{name: "changes", method: http.MethodGet, path: "/v1/changes?key=config/a&timeout=1ms", auth: "Bearer reader-token", code: http.StatusOK},
+		{name: "changes outside prefix", method: http.MethodGet, path: "/v1/changes?key=other", auth: "Bearer reader-token", code: http.StatusForbidden},
+		{
+			name: "txn", method: http.MethodPost, path: "/v1/txn", auth: "Bearer writer-token",
+			body: `{"checks":[{"key":"config/a","value":"1"}],"ops":[{"op":"put","key":"config/b","value":"2"}]}`, code: http.StatusOK,
+		},
+		{
+			name: "txn check outside prefix", method: http.MethodPost, path: "/v1/txn", auth: "Bearer writer-token",
+			body: `{"checks":[{"key":"other"}],"ops":[{"op":"put","key":"config/b","value":"2"}]}`, code: http.StatusForbidden,
+		},
+		{
+			name: "txn delete without grant", method: http.MethodPost, path: "/v1/txn", auth: "Bearer writer-token",
+			body: `{"ops":[{"op":"delete","key":"config/a"}]}`, code: http.StatusForbidden,
+		},
+		{name: "namespace", method: http.MethodPut, path: "/v1/ns/team/keys/a", body: "1", auth: "Bearer writer-token", code: http.StatusCreated},
+		{name: "namespace without grant", method: http.MethodGet, path: "/v1/ns/team/keys/config/a", auth: "Bearer reader-token", code: http.StatusForbidden},
+		{name: "limits", method: http.MethodGet, path: "/v1/limits", auth: "Bearer reader-token", code: http.StatusOK},
+		{name: "namespaces", method: http.MethodGet, path: "/v1/ns", auth: "Bearer writer-token", code: http.StatusForbidden},
+		{name: "namespaces as admin", method: http.MethodGet, path: "/v1/ns", auth: "Bearer admin-token", code: http.StatusOK},
+		{name: "create namespace", method: http.MethodPut, path: "/v1/ns/other", auth: "Bearer writer-token", code: http.StatusForbidden},
+		{name: "openapi", method: http.MethodGet, path: "/v1/openapi.json", code: http.StatusOK},
+		{name: "metrics", method: http.MethodGet, path: "/metrics", code: http.StatusUnauthorized},
+		{name: "metrics without admin", method: http.MethodGet, path: "/metrics", auth: "Bearer reader-token", code: http.StatusForbidden},
+		{name: "metrics as admin", method: http.MethodGet, path: "/metrics", auth: "Bearer admin-token", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{"config/a": "1"})
+			s.auth = testAuthenticator(t, testTokens)
+			_, err := s.ns.create(quota{Name: "team"})
+			is.NoErr(err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)).WithContext(ctx)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			// streams end once the client is gone
+			cancel()
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			switch tt.code {
+			case http.StatusUnauthorized:
+				is.Equal(w.Header().Get("WWW-Authenticate"), bearerChallenge)
+				is.Equal(problemCode(t, w), codeUnauthorized)
+			case http.StatusForbidden:
+				is.Equal(problemCode(t, w), codeForbidden)
+			}
+		})
+	}
+}
+
+func problemCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	is := is.New(t)
+	var p problem
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &p))
+	return p.Code
+}
+
+func TestBatchAuthorization(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	s := testServer(map[string]string{"config/a": "1", "other": "2"})
+	s.auth = testAuthenticator(t, testTokens)
+
+	body := `[{"op":"get","key":"config/a"},{"op":"get","key":"other"},{"op":"put","key":"config/b","value":"3"}]`
+	req := httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer reader-token")
+	w := httptest.NewRecorder()
+	s.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusOK)
+	var resps []batchResponse
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &resps))
+	is.Equal(len(resps), 3)
+	is.Equal(resps[0].Status, http.StatusOK)
+	// denied operations fail on their own
+	is.Equal(resps[1].Status, http.StatusForbidden)
+	is.Equal(resps[1].Code, codeForbidden)
+	is.Equal(resps[2].Status, http.StatusForbidden)
+	_, ok, _ := s.db.get("config/b")
+	is.True(!ok)
+}
+
+func TestReloadTokens(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	a := testAuthenticator(t, `{"tokens": [{"name": "old", "token": "old-token", "admin": true}]}`)
+	authenticate := func(token string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/v1/limits", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := a.authenticate(req)
+		return err == nil
+	}
+	is.True(authenticate("old-token"))
+
+	is.NoErr(os.WriteFile(a.path, []byte(`{"tokens": [{"name": "new", "token": "new-token", "admin": true}]}`), 0o600))
+	n, err := a.reload()
+	is.NoErr(err)
+	is.Equal(n, 1)
+	is.True(!authenticate("old-token"))
+	is.True(authenticate("new-token"))
+
+	// an invalid file keeps the tokens
+	is.NoErr(os.WriteFile(a.path, []byte(`{"tokens": [{"name": "broken"}]}`), 0o600))
+	_, err = a.reload()
+	is.True(err != nil)
+	is.True(authenticate("new-token"))
+}
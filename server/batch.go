@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxBatchOps      = 1000
+	ndjsonMediaType  = "application/x-ndjson"
+	jsonMediaType    = "application/json"
+	maxNDJSONLineLen = 1 << 20
+	// maxBatchBytes is the maximum size of the body of a batch or transaction
+	maxBatchBytes = 32 << 20
+)
+
+// op is a single operation of a batch, kind is http.MethodGet, http.MethodPut or http.MethodDelete.
+type op struct {
+	kind  string
+	key   string
+	value string
+	// opts.cond applies to deletes as well
+	opts putOptions
+}
+
+// opResult is the outcome of an op.
+// code is http.StatusOK or, for a put of a new key, http.StatusCreated if err is nil.
+type opResult struct {
+	code  int
+	entry entry
+	err   error
+}
+
+var errUnknownOp = errors.New("error: unknown operation, use either 'get', 'put' or 'delete'")
+
+// lockedStore is implemented by stores whose operations can run while the caller holds the store lock.
+type lockedStore interface {
+	getLocked(key string) (entry, bool, error)
+	putLocked(key string, value string, opts putOptions) (int, uint64, error)
+	deleteLocked(key string, cond precondition) error
+}
+
+// applyBatch runs the operations on s, the caller must hold the lock of s.
+func applyBatch(s lockedStore, ops []op) []opResult {
+	results := make([]opResult, len(ops))
+	for i, o := range ops {
+		var res opResult
+		switch o.kind {
+		case http.MethodGet:
+			e, ok, err := s.getLocked(o.key)
+			if err != nil {
+				res.err = err
+				break
+			}
+			if !ok {
+				res.err = &NoEntryError{key: o.key}
+				break
+			}
+			res.code, res.entry = http.StatusOK, e
+		case http.MethodPut:
+			code, version, err := s.putLocked(o.key, o.value, o.opts)
+			res.code, res.entry, res.err = code, entry{value: o.value, version: version, content: o.opts.content}, err
+		case http.MethodDelete:
+			res.code, res.err = http.StatusOK, s.deleteLocked(o.key, o.opts.cond)
+		default:
+			res.err = errUnknownOp
+		}
+		results[i] = res
+	}
+	return results
+}
+
+// encodingBase64 marks a value in a JSON body as base64 encoded.
+// JSON strings only hold UTF-8, so values that aren't valid UTF-8 are sent that way.
+const encodingBase64 = "base64"
+
+// jsonValue returns value as the value of a JSON body and its encoding.
+func jsonValue(value string) (*string, string) {
+	if utf8.ValidString(value) {
+		return &value, ""
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(value))
+	return &encoded, encodingBase64
+}
+
+// parseJSONValue returns the value of a JSON body with the encoding, either empty or base64.
+func parseJSONValue(value string, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case encodingBase64:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("error: value is not valid base64: %w", err)
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("error: unknown encoding %q, use 'base64'", encoding) //nolint:goerr113
+	}
+}
+
+// batchRequest is an operation in the body of a batch request.
+type batchRequest struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+	IfMatch     string `json:"ifMatch,omitempty"`
+	IfNoneMatch string `json:"ifNoneMatch,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// batchResponse is the result of the operation at the same position of the request.
+type batchResponse struct {
+	Status      int     `json:"status"`
+	Value       *string `json:"value,omitempty"`
+	Encoding    string  `json:"encoding,omitempty"`
+	ContentType string  `json:"contentType,omitempty"`
+	ETag        string  `json:"etag,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	// Code is the error code of a failed operation, like the code of a problem document
+	Code string `json:"code,omitempty"`
+}
+
+// handleBatch runs a list of get, put and delete operations in one request.
+// The body is either a JSON array or, with the Content-Type application/x-ndjson,
+// one operation per line. The response has the same format and a result per operation.
+func (s *server) handleBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ndjson := strings.HasPrefix(r.Header.Get("Content-Type"), ndjsonMediaType)
+		reqs, err := decodeBatch(http.MaxBytesReader(w, r.Body, maxBatchBytes), ndjson)
+		if err != nil {
+			s.writeError(w, r, &RequestError{err: err})
+			return
+		}
+		if len(reqs) > maxBatchOps {
+			s.writeError(w, r, &TooManyOpsError{maxOps: maxBatchOps})
+			return
+		}
+
+		resps := make([]batchResponse, len(reqs))
+		ops := make([]op, 0, len(reqs))
+		// index maps ops to their request, invalid requests have no op
+		index := make([]int, 0, len(reqs))
+		for i, req := range reqs {
+			o, err := req.op()
+			if err == nil {
+				err = s.authorize(r, o.key, permissionOf(o.kind))
+			}
+			if err != nil {
+				resps[i] = newBatchResponse("", opResult{err: err})
+				continue
+			}
+			ops = append(ops, o)
+			index = append(index, i)
+		}
+		for i, res := range s.store(r).batch(ops) {
+			resps[index[i]] = newBatchResponse(ops[i].kind, res)
+		}
+
+		if ndjson {
+			w.Header().Set("Content-Type", ndjsonMediaType)
+		} else {
+			w.Header().Set("Content-Type", jsonMediaType)
+		}
+		if err := encodeBatch(w, resps, ndjson); err != nil {
+			s.log.Info("Error writing response", "error", err)
+		}
+	}
+}
+
+// decodeBatch returns the operations of the body, it stops after one more than maxBatchOps.
+func decodeBatch(r io.Reader, ndjson bool) ([]batchRequest, error) {
+	if !ndjson {
+		return decodeBatchArray(r)
+	}
+	var reqs []batchRequest
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxNDJSONLineLen)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var req batchRequest
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			return nil, fmt.Errorf("error: line %d is not a JSON operation: %w", line, err)
+		}
+		reqs = append(reqs, req)
+		if len(reqs) > maxBatchOps {
+			break
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error: can't read body: %w", err)
+	}
+	return reqs, nil
+}
+
+// decodeBatchArray decodes the operations of a JSON array one by one, so a batch with too many is never read completely.
+func decodeBatchArray(r io.Reader) ([]batchRequest, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		if err == nil {
+			err = fmt.Errorf("unexpected %v", tok) //nolint:goerr113
+		}
+		return nil, fmt.Errorf("error: body is not a JSON array of operations: %w", err)
+	}
+	var reqs []batchRequest
+	for dec.More() {
+		var req batchRequest
+		if err := dec.Decode(&req); err != nil {
+			return nil, fmt.Errorf("error: body is not a JSON array of operations: %w", err)
+		}
+		reqs = append(reqs, req)
+		if len(reqs) > maxBatchOps {
+			return reqs, nil
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("error: body is not a JSON array of operations: %w", err)
+	}
+	return reqs, nil
+}
+
+func encodeBatch(w io.Writer, resps []batchResponse, ndjson bool) error {
+	enc := json.NewEncoder(w)
+	if !ndjson {
+		return enc.Encode(resps) //nolint:wrapcheck
+	}
+	for _, resp := range resps {
+		if err := enc.Encode(resp); err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
+	return nil
+}
+
+// op converts the request to an op, the TTL and ETags are parsed like the query and headers of /db.
+func (req batchRequest) op() (op, error) {
+	o := op{kind: strings.ToUpper(req.Op), key: req.Key}
+	switch o.kind {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+	default:
+		return o, errUnknownOp
+	}
+	value, err := parseJSONValue(req.Value, req.Encoding)
+	if err != nil {
+		return o, &RequestError{err: err}
+	}
+	o.value = value
+	if req.TTL != "" {
+		ttl, err := parseTTLValue(req.TTL)
+		if err != nil {
+			return o, &RequestError{err: err}
+		}
+		o.opts.ttl = ttl
+	}
+	if req.IfMatch != "" {
+		o.opts.cond.ifMatch = parseETagList([]string{req.IfMatch})
+	}
+	if req.IfNoneMatch != "" {
+		o.opts.cond.ifNoneMatch = parseETagList([]string{req.IfNoneMatch})
+	}
+	o.opts.content = content{typ: req.ContentType}
+	if err := o.opts.content.validate(); err != nil {
+		return o, &RequestError{err: err}
+	}
+	return o, nil
+}
+
+func newBatchResponse(kind string, res opResult) batchResponse {
+	if res.err != nil {
+		p := problemOf(res.err)
+		return batchResponse{Status: p.Status, Code: p.Code, Error: res.err.Error()}
+	}
+	resp := batchResponse{Status: res.code}
+	switch kind {
+	case http.MethodGet:
+		resp.Value, resp.Encoding = jsonValue(res.entry.value)
+		resp.ContentType = res.entry.content.typ
+		resp.ETag = formatETag(res.entry.version)
+	case http.MethodPut:
+		resp.ETag = formatETag(res.entry.version)
+	}
+	return resp
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestStoreBatch(t *testing.T) {
+	t.Parallel()
+	for name, open := range testStores(defaultLimits()) {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := open(t)
+
+			results := s.batch([]op{
+				{kind: http.MethodPut, key: "a", value: "1"},
+				{kind: http.MethodPut, key: "a", value: "2"},
+				{kind: http.MethodGet, key: "a"},
+				{kind: http.MethodPut, key: "toooooooooooooooooooolong", value: "1"},
+				{kind: http.MethodDelete, key: "missing"},
+				{kind: http.MethodDelete, key: "a"},
+				{kind: http.MethodGet, key: "a"},
+			})
+			codes := make([]int, 0, len(results))
+			for _, res := range results {
+				if res.err != nil {
+					codes = append(codes, errorStatus(res.err))
+				} else {
+					codes = append(codes, res.code)
+				}
+			}
+			is.Equal(codes, []int{
+				http.StatusCreated, http.StatusOK, http.StatusOK, http.StatusRequestEntityTooLarge,
+				http.StatusNotFound, http.StatusOK, http.StatusNotFound,
+			})
+			is.Equal(results[2].entry.value, "2")
+			is.Equal(results[2].entry.version, results[1].entry.version)
+		})
+	}
+}
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+		want        []batchResponse
+	}{
+		{
+			name: "json",
+			body: `[{"op":"put","key":"a","value":"1"},{"op":"get","key":"exists"},{"op":"delete","key":"missing"}]`,
+			code: http.StatusOK,
+			want: []batchResponse{
+				{Status: http.StatusCreated, ETag: `"1"`},
+				{Status: http.StatusOK, Value: strPtr("exists"), ETag: `"0"`},
+				{Status: http.StatusNotFound, Error: `error: key "missing" does not exist`, Code: codeNotFound},
+			},
+		},
+		{
+			name:        "ndjson",
+			contentType: ndjsonMediaType,
+			body:        "{\"op\":\"put\",\"key\":\"a\",\"value\":\"1\"}\n\n{\"op\":\"get\",\"key\":\"a\"}\n",
+			code:        http.StatusOK,
+			want: []batchResponse{
+				{Status: http.StatusCreated, ETag: `"1"`},
+				{Status: http.StatusOK, Value: strPtr("1"), ETag: `"1"`},
+			},
+		},
+		{
+			name: "invalid operations",
+			body: `[{"op":"patch","key":"a"},{"op":"put","key":"a","ttl":"-1s"},{"op":"put","key":"exists","ifMatch":"\"7\""}]`,
+			code: http.StatusOK,
+			want: []batchResponse{
+				{Status: http.StatusBadRequest, Error: errUnknownOp.Error(), Code: codeUnknownOp},
+				{Status: http.StatusBadRequest, Error: `error: ttl "-1s" is not a positive duration like "30s"`, Code: codeInvalidRequest},
+				{Status: http.StatusPreconditionFailed, Error: `error: precondition for key "exists" failed`, Code: codePreconditionFailed},
+			},
+		},
+		{
+			name: "binary value",
+			body: `[{"op":"put","key":"a","value":"//4A","encoding":"base64"},{"op":"get","key":"a"}]`,
+			code: http.StatusOK,
+			want: []batchResponse{
+				{Status: http.StatusCreated, ETag: `"1"`},
+				{Status: http.StatusOK, Value: strPtr("//4A"), Encoding: encodingBase64, ETag: `"1"`},
+			},
+		},
+		{
+			name: "invalid encodings",
+			body: `[{"op":"put","key":"a","value":"1","encoding":"hex"},{"op":"put","key":"a","value":"!","encoding":"base64"}]`,
+			code: http.StatusOK,
+			want: []batchResponse{
+				{Status: http.StatusBadRequest, Error: `error: unknown encoding "hex", use 'base64'`, Code: codeInvalidRequest},
+				{Status: http.StatusBadRequest, Error: "error: value is not valid base64: illegal base64 data at input byte 0", Code: codeInvalidRequest},
+			},
+		},
+		{name: "invalid json", body: `{"op":"get"}`, code: http.StatusBadRequest},
+		{name: "invalid ndjson", contentType: ndjsonMediaType, body: "[]\n", code: http.StatusBadRequest},
+		{name: "too many operations", body: "[" + strings.Repeat(`{"op":"get"},`, maxBatchOps) + `{"op":"get"}]`, code: http.StatusRequestEntityTooLarge},
+		{
+			// the operations after the limit are not read
+			name: "too many operations before invalid json", body: "[" + strings.Repeat(`{"op":"get"},`, maxBatchOps+1) + `{"op":`,
+			code: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "body too large", body: `[{"op":"put","key":"a","value":"` + strings.Repeat("a", maxBatchBytes) + `"}]`,
+			code: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			s := testServer(map[string]string{"exists": "exists"})
+			req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var resps []batchResponse
+			if tt.contentType == ndjsonMediaType {
+				is.Equal(w.Header().Get("Content-Type"), ndjsonMediaType)
+				dec := json.NewDecoder(w.Body)
+				for dec.More() {
+					var resp batchResponse
+					is.NoErr(dec.Decode(&resp))
+					resps = append(resps, resp)
+				}
+			} else {
+				is.NoErr(json.NewDecoder(w.Body).Decode(&resps))
+			}
+			is.Equal(resps, tt.want)
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestBinaryValues(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	s := testServer(map[string]string{})
+	_, _, err := s.db.put("a", "\xff\xfe\x00", putOptions{})
+	is.NoErr(err)
+	_, _, err = s.db.put("b", "ü", putOptions{})
+	is.NoErr(err)
+	s.routes()
+
+	get := func(path string, v any) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, req)
+		is.Equal(w.Code, http.StatusOK)
+		is.NoErr(json.NewDecoder(w.Body).Decode(v))
+	}
+	// values that aren't valid UTF-8 are base64 encoded, the others are sent as they are
+	var keys scanResponse
+	get("/v1/keys?values=true", &keys)
+	is.Equal(*keys.Keys[0].Value, "//4A")
+	is.Equal(keys.Keys[0].Encoding, encodingBase64)
+	is.Equal(*keys.Keys[1].Value, "ü")
+	is.Equal(keys.Keys[1].Encoding, "")
+
+	var history historyResponse
+	get("/v1/history?key=a", &history)
+	is.Equal(*history.Revisions[0].Value, "//4A")
+	is.Equal(history.Revisions[0].Encoding, encodingBase64)
+
+	var changes changesResponse
+	get("/v1/changes?key=a&after=0", &changes)
+	is.Equal(*changes.Changes[0].Value, "//4A")
+	is.Equal(changes.Changes[0].Encoding, encodingBase64)
+}
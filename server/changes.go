@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 5 * time.Minute
+)
+
+// pollOptions are the parameters of a long poll for changes.
+type pollOptions struct {
+	watch   watchOptions
+	timeout time.Duration
+}
+
+// parsePollOptions reads the key or prefix, the revision after which changes are returned and the timeout.
+func parsePollOptions(r *http.Request) (pollOptions, error) {
+	q := r.URL.Query()
+	watch, err := parseWatchKey(q)
+	if err != nil {
+		return pollOptions{}, err
+	}
+	opts := pollOptions{watch: watch, timeout: defaultPollTimeout}
+	if v := q.Get("after"); v != "" {
+		after, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("error: after %q is not a revision", v) //nolint:goerr113
+		}
+		opts.watch.rev = after + 1
+	}
+	if v := q.Get("timeout"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 || timeout > maxPollTimeout {
+			return opts, fmt.Errorf("error: timeout %q is not a duration up to %s", v, maxPollTimeout) //nolint:goerr113
+		}
+		opts.timeout = timeout
+	}
+	return opts, nil
+}
+
+type changeEvent struct {
+	Op       string  `json:"op"`
+	Key      string  `json:"key"`
+	Value    *string `json:"value,omitempty"`
+	Encoding string  `json:"encoding,omitempty"`
+	Revision uint64  `json:"revision"`
+}
+
+type changesResponse struct {
+	Changes []changeEvent `json:"changes"`
+	// Revision is the after parameter of the next poll
+	Revision uint64 `json:"revision"`
+}
+
+// handleChanges answers with the changes of a key or prefix after a revision.
+// If there are none yet, it waits for the next change or until the timeout elapses.
+// Without the after parameter it only waits for new changes.
+func (s *server) handleChanges() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wt, ok := s.store(r).(watcher)
+		if !ok {
+			s.writeError(w, r, &UnsupportedError{feature: "watches"})
+			return
+		}
+		opts, err := parsePollOptions(r)
+		if err != nil {
+			s.writeError(w, r, &RequestError{err: err})
+			return
+		}
+		if err := s.authorize(r, opts.watch.key, permRead); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		sub, changes, err := wt.watch(opts.watch)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		defer wt.unwatch(sub)
+		if len(changes) == 0 {
+			changes = poll(r, sub, opts.timeout)
+		}
+
+		resp := changesResponse{Changes: make([]changeEvent, 0, len(changes)), Revision: sub.rev}
+		if opts.watch.rev > resp.Revision {
+			resp.Revision = opts.watch.rev - 1
+		}
+		for _, c := range changes {
+			ev := changeEvent{Op: c.op, Key: c.key, Revision: c.rev}
+			if c.op == changePut {
+				ev.Value, ev.Encoding = jsonValue(c.value)
+			}
+			resp.Changes = append(resp.Changes, ev)
+			resp.Revision = c.rev
+		}
+		w.Header().Set("Content-Type", jsonMediaType)
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			s.log.Info("Error writing response", "error", err)
+		}
+	}
+}
+
+// poll waits for the next changes of sub and returns them together with the changes that are already queued.
+func poll(r *http.Request, sub *subscription, timeout time.Duration) []change {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case changes, ok := <-sub.c:
+		if !ok {
+			return nil
+		}
+		for {
+			select {
+			case more, ok := <-sub.c:
+				if !ok {
+					return changes
+				}
+				changes = append(changes, more...)
+			default:
+				return changes
+			}
+		}
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestChanges(t *testing.T) {
+	t.Parallel()
+	value := func(v string) *string { return &v }
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		want  changesResponse
+	}{
+		{
+			name:  "after revision",
+			query: "?prefix=a&after=1",
+			code:  http.StatusOK,
+			want: changesResponse{
+				Changes: []changeEvent{
+					{Op: changePut, Key: "a/2", Value: value("2"), Revision: 2},
+					{Op: changeDelete, Key: "a/1", Revision: 3},
+					{Op: changePut, Key: "a/3", Value: value("3"), Revision: 4},
+				},
+				Revision: 4,
+			},
+		},
+		{
+			name:  "key",
+			query: "?key=a/1&after=0",
+			code:  http.StatusOK,
+			want: changesResponse{
+				Changes: []changeEvent{
+					{Op: changePut, Key: "a/1", Value: value("1"), Revision: 1},
+					{Op: changeDelete, Key: "a/1", Revision: 3},
+				},
+				Revision: 3,
+			},
+		},
+		{name: "timeout", query: "?key=b&after=1&timeout=0s", code: http.StatusOK, want: changesResponse{Changes: []changeEvent{}, Revision: 4}},
+		{name: "no after", query: "?timeout=0s", code: http.StatusOK, want: changesResponse{Changes: []changeEvent{}, Revision: 4}},
+		{name: "future", query: "?after=9&timeout=0s", code: http.StatusOK, want: changesResponse{Changes: []changeEvent{}, Revision: 9}},
+		{name: "invalid after", query: "?after=x", code: http.StatusBadRequest},
+		{name: "invalid timeout", query: "?timeout=1h", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			s := testServer(map[string]string{})
+			for _, key := range []string{"a/1", "a/2"} {
+				_, _, err := s.db.put(key, key[2:], putOptions{})
+				is.NoErr(err)
+			}
+			is.NoErr(s.db.delete("a/1", precondition{}))
+			_, _, err := s.db.put("a/3", "3", putOptions{})
+			is.NoErr(err)
+
+			req := httptest.NewRequest(http.MethodGet, "/changes"+tt.query, nil)
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			var resp changesResponse
+			is.NoErr(json.NewDecoder(w.Body).Decode(&resp))
+			is.Equal(resp, tt.want)
+		})
+	}
+}
+
+func TestChangesWait(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	s := testServer(map[string]string{})
+	s.routes()
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	done := make(chan changesResponse)
+	go func() {
+		var resp changesResponse
+		r, err := http.Get(ts.URL + "/changes?prefix=a&timeout=10s")
+		if err == nil {
+			defer r.Body.Close()
+			err = json.NewDecoder(r.Body).Decode(&resp)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+	// wait until the poll is subscribed, a change before it isn't part of the response
+	db := s.db.(*database)
+	for {
+		db.changes.mu.Lock()
+		n := len(db.changes.subs)
+		db.changes.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, err := db.txn(txn{ops: []op{
+		{kind: http.MethodPut, key: "a", value: "1"},
+		{kind: http.MethodPut, key: "b", value: "2"},
+		{kind: http.MethodPut, key: "ab", value: "3"},
+	}})
+	is.NoErr(err)
+
+	resp := <-done
+	// all changes of a transaction are returned together
+	is.Equal(len(resp.Changes), 2)
+	is.Equal(resp.Revision, uint64(1))
+}
+
+func TestChangesCompacted(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	s := testServer(map[string]string{})
+	s.db.(*database).rev = 5
+	req := httptest.NewRequest(http.MethodGet, "/changes?after=2", nil)
+	w := httptest.NewRecorder()
+	s.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusGone)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etagList is the parsed value of an If-Match or If-None-Match header.
+type etagList struct {
+	present  bool
+	any      bool
+	versions []uint64
+}
+
+// matches reports if an entry with version matches the list, a missing entry never matches.
+func (l etagList) matches(version uint64, exists bool) bool {
+	if !exists {
+		return false
+	}
+	if l.any {
+		return true
+	}
+	for _, v := range l.versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// precondition makes a write depend on the version of the current entry.
+// The zero value has no conditions.
+type precondition struct {
+	ifMatch     etagList
+	ifNoneMatch etagList
+}
+
+// check reports if the current entry, which may not exist, satisfies the precondition.
+func (p precondition) check(version uint64, exists bool) bool {
+	if p.ifMatch.present && !p.ifMatch.matches(version, exists) {
+		return false
+	}
+	if p.ifNoneMatch.present && p.ifNoneMatch.matches(version, exists) {
+		return false
+	}
+	return true
+}
+
+type PreconditionError struct {
+	key string
+}
+
+func (e *PreconditionError) Error() string {
+	return fmt.Sprintf("error: precondition for key \"%s\" failed", e.key)
+}
+
+// formatETag returns the strong entity tag of an entry version.
+func formatETag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// notModified reports if a GET or HEAD can be answered with 304 Not Modified, because the entry
+// wasn't modified since the If-Modified-Since header. As in RFC 9110 the header is ignored
+// if the request has an If-None-Match header, or if it can't be parsed.
+func notModified(r *http.Request, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	v := r.Header.Get("If-Modified-Since")
+	if v == "" || modified.IsZero() || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(v)
+	if err != nil {
+		return false
+	}
+	// Last-Modified has a resolution of a second
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// parsePrecondition reads the If-Match and If-None-Match headers of r.
+// Weak and malformed tags never match, as If-Match requires the strong comparison.
+func parsePrecondition(r *http.Request) precondition {
+	return precondition{
+		ifMatch:     parseETagList(r.Header.Values("If-Match")),
+		ifNoneMatch: parseETagList(r.Header.Values("If-None-Match")),
+	}
+}
+
+func parseETagList(values []string) etagList {
+	var l etagList
+	for _, v := range values {
+		l.present = true
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				l.any = true
+				continue
+			}
+			s, err := strconv.Unquote(tag)
+			if err != nil || !strings.HasPrefix(tag, `"`) {
+				continue
+			}
+			if version, err := strconv.ParseUint(s, 10, 64); err == nil {
+				l.versions = append(l.versions, version)
+			}
+		}
+	}
+	return l
+}
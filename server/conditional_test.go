@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParseETagList(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		values []string
+		want   etagList
+	}{
+		{name: "absent", want: etagList{}},
+		{name: "any", values: []string{"*"}, want: etagList{present: true, any: true}},
+		{name: "single", values: []string{`"5"`}, want: etagList{present: true, versions: []uint64{5}}},
+		{name: "list", values: []string{`"5", "7"`, `"9"`}, want: etagList{present: true, versions: []uint64{5, 7, 9}}},
+		{name: "weak and malformed", values: []string{`W/"5", 6, "x"`}, want: etagList{present: true}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			is.Equal(parseETagList(tt.values), tt.want)
+		})
+	}
+}
+
+func TestStoreCompareAndSwap(t *testing.T) {
+	t.Parallel()
+	ifMatch := func(v uint64) precondition {
+		return precondition{ifMatch: etagList{present: true, versions: []uint64{v}}}
+	}
+	createOnly := precondition{ifNoneMatch: etagList{present: true, any: true}}
+	for name, open := range testStores(defaultLimits()) {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := open(t)
+			var preconditionErr *PreconditionError
+
+			_, v1, err := s.put("a", "1", putOptions{cond: createOnly})
+			is.NoErr(err)
+			_, _, err = s.put("a", "2", putOptions{cond: createOnly})
+			is.True(errors.As(err, &preconditionErr))
+
+			_, v2, err := s.put("a", "2", putOptions{cond: ifMatch(v1)})
+			is.NoErr(err)
+			is.True(v2 > v1)
+			// a second writer with the old version loses
+			_, _, err = s.put("a", "3", putOptions{cond: ifMatch(v1)})
+			is.True(errors.As(err, &preconditionErr))
+			e, _, _ := s.get("a")
+			is.True(!e.times.created.After(e.times.modified))
+			e.times = times{}
+			is.Equal(e, entry{value: "2", version: v2, created: v1})
+
+			is.True(errors.As(s.delete("a", ifMatch(v1)), &preconditionErr))
+			is.NoErr(s.delete("a", ifMatch(v2)))
+			// If-Match never matches a missing key
+			_, _, err = s.put("a", "4", putOptions{cond: precondition{ifMatch: etagList{present: true, any: true}}})
+			is.True(errors.As(err, &preconditionErr))
+		})
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		method      string
+		ifMatch     string
+		ifNoneMatch string
+		code        int
+	}{
+		{name: "put matching", method: http.MethodPut, ifMatch: `"1"`, code: http.StatusOK},
+		{name: "put stale", method: http.MethodPut, ifMatch: `"2"`, code: http.StatusPreconditionFailed},
+		{name: "put create only", method: http.MethodPut, ifNoneMatch: "*", code: http.StatusPreconditionFailed},
+		{name: "put not this version", method: http.MethodPut, ifNoneMatch: `"2"`, code: http.StatusOK},
+		{name: "delete matching", method: http.MethodDelete, ifMatch: `"3", "1"`, code: http.StatusOK},
+		{name: "delete stale", method: http.MethodDelete, ifMatch: `"2"`, code: http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			s := testServer(map[string]string{})
+			req := httptest.NewRequest(http.MethodPut, "/db?key=test", strings.NewReader("v"))
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, http.StatusCreated)
+			is.Equal(w.Header().Get("ETag"), `"1"`)
+
+			req = httptest.NewRequest(tt.method, "/db?key=test", strings.NewReader("new"))
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w = httptest.NewRecorder()
+			s.mux.ServeHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+
+			req = httptest.NewRequest(http.MethodGet, "/db?key=test", nil)
+			w = httptest.NewRecorder()
+			s.mux.ServeHTTP(w, req)
+			switch {
+			case tt.code == http.StatusPreconditionFailed:
+				is.Equal(w.Header().Get("ETag"), `"1"`)
+				is.Equal(w.Body.String(), "v")
+			case tt.method == http.MethodPut:
+				is.Equal(w.Header().Get("ETag"), `"2"`)
+			default:
+				is.Equal(w.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
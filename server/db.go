@@ -1,44 +1,275 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
 const (
-	maxKeyLen         = 20
-	maxValueLen       = 200
-	maxDatabaseLength = 2000
-	filePerm          = 0o600
+	filePerm        = 0o600
+	snapshotBackups = 3
 )
 
+// entry is a value with its metadata.
+type entry struct {
+	value string
+	// expires is zero for entries without a TTL
+	expires time.Time
+	// version is the revision of the database that wrote the entry
+	version uint64
+	// created is the revision that created the key, it's kept by updates
+	created uint64
+	content content
+	times   times
+}
+
+// content is the media type of a value as sent with the PUT, both are empty if the value has none.
+type content struct {
+	// typ is the Content-Type of the value
+	typ string
+	// encoding is the Content-Encoding of the value, e.g. gzip
+	encoding string
+}
+
+// times are the wall clock times of the writes of a key.
+// Both are zero for entries written before the times were recorded.
+type times struct {
+	// created is the time the key was created, it's kept by updates
+	created time.Time
+	// modified is the time of the last write
+	modified time.Time
+}
+
+// toSnapshot returns the entry as the snapshot record of key.
+func (e entry) toSnapshot(key string) snapshotEntry {
+	return snapshotEntry{key: key, value: e.value, expires: e.expires, version: e.version, created: e.created, content: e.content, times: e.times}
+}
+
+// putOptions are the optional parameters of a put.
+type putOptions struct {
+	// ttl lets the entry expire after that duration if positive
+	ttl  time.Duration
+	cond precondition
+	// content is stored with the value
+	content content
+	// keepExpiry keeps the expiry of the current entry unless ttl is set
+	keepExpiry bool
+}
+
 type database struct {
-	mu sync.Mutex
-	db map[string]string
+	mu      sync.Mutex
+	db      map[string]entry
+	path    string
+	backups int
+	limits  limits
+	// size is the total length of all keys and values in bytes
+	size int
+	// rev is incremented by every write, it's never reused so versions identify a write
+	rev uint64
+	// snapshotRev is the revision of the loaded snapshot, the write-ahead log is replayed after it
+	snapshotRev uint64
+	now         func() time.Time
+	// usage decides which entries are evicted when the database is full, it's nil for evictReject
+	usage     *usage
+	evictions uint64
+	// wal logs every mutation before it is applied, it's nil if the database isn't durable
+	wal *wal
+	// changes notifies watchers about every write
+	changes *feed
+	// history holds the previous writes of the keys, at most historyLen per key
+	history    map[string]*keyHistory
+	historyLen int
+	// historyFloor is the revision from which on the history is complete, apart from per key limits
+	historyFloor uint64
+	// graves are the deleted keys that still have a history, oldest first
+	graves []tombstone
+	// historyBytes is the size of all writes in the history
+	historyBytes int
+	// historyOrder queues the writes in the history, oldest first, if limits.Bytes is set
+	historyOrder    []historyRef
+	historyOrderMax int
 }
 
-func (db *database) delete(key string) error {
+func newDatabase(path string, l limits) *database {
+	return &database{
+		db:         make(map[string]entry),
+		path:       path,
+		backups:    snapshotBackups,
+		limits:     l,
+		now:        time.Now,
+		changes:    newFeed(),
+		history:    make(map[string]*keyHistory),
+		historyLen: defaultHistory,
+	}
+}
+
+// loadDatabase restores the database from the snapshot at path.
+// A missing snapshot is not an error, the database then starts empty.
+// Any snapshot that can't be read completely or violates the limits is rejected
+// so that a bad file is never silently replaced by the next persist.
+func loadDatabase(path string, l limits) (*database, error) {
+	db := newDatabase(path, l)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read snapshot: %w", err)
+	}
+	defer f.Close()
+	rev, entries, err := decodeSnapshot(f)
+	if err != nil {
+		return nil, &SnapshotError{path: path, err: err}
+	}
+	db.rev = rev
+	db.snapshotRev = rev
+	// writes before the snapshot are gone
+	db.historyFloor = rev
+	if len(entries) > l.Entries {
+		return nil, &SnapshotError{path: path, err: &DatabaseError{maxLen: l.Entries}}
+	}
+	for _, e := range entries {
+		if err := l.validate(e.key, e.value); err != nil {
+			return nil, &SnapshotError{path: path, err: fmt.Errorf("entry %q: %w", e.key, err)}
+		}
+		if _, ok := db.db[e.key]; ok {
+			return nil, &SnapshotError{path: path, err: fmt.Errorf("entry %q: %w", e.key, errDuplicateKey)}
+		}
+		created := e.created
+		if created == 0 {
+			created = e.version
+		}
+		db.set(e.key, entry{value: e.value, expires: e.expires, version: e.version, created: created, content: e.content, times: e.times})
+	}
+	if err := l.checkBytes(db.size); err != nil {
+		return nil, &SnapshotError{path: path, err: err}
+	}
+	return db, nil
+}
+
+// quarantine moves an unusable snapshot or write-ahead log out of the way so it is kept for inspection.
+func quarantine(path string) (string, error) {
+	dst := path + ".corrupt"
+	if err := os.Rename(path, dst); err != nil {
+		return "", fmt.Errorf("can't move snapshot aside: %w", err)
+	}
+	return dst, nil
+}
+
+func (db *database) delete(key string, cond precondition) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	_, ok := db.db[key]
+	return db.deleteLocked(key, cond)
+}
+
+// deleteLocked is delete for callers that hold db.mu.
+func (db *database) deleteLocked(key string, cond precondition) error {
+	e, ok := db.lookup(key)
+	if !cond.check(e.version, ok) {
+		return &PreconditionError{key: key}
+	}
 	if !ok {
 		return &NoEntryError{key: key}
 	}
-	delete(db.db, key)
+	return db.removeLogged(key)
+}
+
+// removeLogged logs the delete of key with a new revision and applies it.
+// The caller must hold db.mu.
+func (db *database) removeLogged(key string) error {
+	version := db.rev + 1
+	if err := db.log(walRecord{op: walOpDelete, key: key, version: version}); err != nil {
+		return err
+	}
+	db.rev = version
+	db.remove(key, version)
+	db.notify(change{op: changeDelete, key: key, rev: version})
 	return nil
 }
 
-func (db *database) get(key string) (string, bool) {
+func (db *database) get(key string) (entry, bool, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	value, ok := db.db[key]
-	if !ok {
-		return "", false
+	return db.getLocked(key)
+}
+
+// getLocked is get for callers that hold db.mu.
+func (db *database) getLocked(key string) (entry, bool, error) {
+	e, ok := db.lookup(key)
+	if ok && db.usage != nil {
+		db.usage.touch(key)
 	}
-	return value, ok
+	return e, ok, nil
+}
+
+// lookup returns the entry of key unless it doesn't exist or has expired.
+// The caller must hold db.mu.
+func (db *database) lookup(key string) (entry, bool) {
+	e, ok := db.db[key]
+	if !ok || db.expired(e) {
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (db *database) expired(e entry) bool {
+	return !e.expires.IsZero() && !db.now().Before(e.expires)
+}
+
+// reap removes all expired entries and returns how many were removed.
+// Like deletes every removal is logged, so it keeps its revision after a restart.
+func (db *database) reap() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n := 0
+	for key, e := range db.db {
+		if db.expired(e) {
+			if db.removeLogged(key) != nil {
+				break
+			}
+			n++
+		}
+	}
+	return n
+}
+
+func (db *database) list() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	keys := make([]string, 0, len(db.db))
+	for key, e := range db.db {
+		if !db.expired(e) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (db *database) scan(opts scanOptions) (scanPage, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var keys []string
+	for key, e := range db.db {
+		if opts.match(key) && !db.expired(e) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	keys, page := paginate(keys, opts.limit)
+	for _, key := range keys {
+		e := db.db[key]
+		page.entries = append(page.entries, e.toSnapshot(key))
+	}
+	return page, nil
 }
 
 type NoEntryError struct {
@@ -49,6 +280,36 @@ func (e *NoEntryError) Error() string {
 	return fmt.Sprintf("error: key \"%s\" does not exist", e.key)
 }
 
+var errDuplicateKey = errors.New("duplicate key")
+
+type SnapshotError struct {
+	path string
+	err  error
+}
+
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("error: snapshot \"%s\" is unusable: %s", e.path, e.err)
+}
+
+func (e *SnapshotError) Unwrap() error {
+	return e.err
+}
+
+// WALError is returned for a write-ahead log with a corrupt record before its last one.
+type WALError struct {
+	path   string
+	offset int
+	err    error
+}
+
+func (e *WALError) Error() string {
+	return fmt.Sprintf("error: write-ahead log \"%s\" is corrupt at byte %d: %s", e.path, e.offset, e.err)
+}
+
+func (e *WALError) Unwrap() error {
+	return e.err
+}
+
 type KeyError struct {
 	maxLen int
 }
@@ -73,36 +334,280 @@ func (e *DatabaseError) Error() string {
 	return fmt.Sprintf("error: database exceeds %d entries", e.maxLen)
 }
 
-func (db *database) put(key string, value string) (int, error) {
+type QuotaError struct {
+	maxBytes int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("error: database exceeds %d bytes", e.maxBytes)
+}
+
+// put stores value under key and returns the version of the new entry.
+func (db *database) put(key string, value string, opts putOptions) (int, uint64, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if len(key) >= maxKeyLen {
-		return 0, &KeyError{maxLen: maxKeyLen}
+	return db.putLocked(key, value, opts)
+}
+
+// putLocked is put for callers that hold db.mu.
+func (db *database) putLocked(key string, value string, opts putOptions) (int, uint64, error) {
+	if err := db.limits.validate(key, value); err != nil {
+		return 0, 0, err
+	}
+	current, ok := db.lookup(key)
+	if !opts.cond.check(current.version, ok) {
+		return 0, 0, &PreconditionError{key: key}
+	}
+	if err := db.makeRoom(key, value); err != nil {
+		return 0, 0, err
+	}
+	now := db.now().Round(0) // the wall clock only, like the times restored from disk
+	e := entry{value: value, version: db.rev + 1, created: db.rev + 1, content: opts.content, times: times{created: now, modified: now}}
+	if ok {
+		e.created = current.created
+		e.times.created = current.times.created
 	}
-	if len(value) >= maxValueLen {
-		return 0, &ValueError{maxLen: maxValueLen}
+	if opts.ttl > 0 {
+		e.expires = now.Add(opts.ttl)
+	} else if opts.keepExpiry && ok {
+		e.expires = current.expires
 	}
-	if len(db.db) >= maxDatabaseLength {
-		return 0, &DatabaseError{maxLen: maxDatabaseLength}
+	rec := walRecord{
+		op: walOpPut, key: key, value: value, expires: e.expires, version: e.version, created: e.created, content: e.content, times: e.times,
 	}
-	_, ok := db.db[key]
-	db.db[key] = value
+	if err := db.log(rec); err != nil {
+		return 0, 0, err
+	}
+	db.rev = e.version
+	db.set(key, e)
+	db.notify(change{op: changePut, key: key, value: value, rev: e.version})
 	if !ok {
-		return http.StatusCreated, nil
+		return http.StatusCreated, e.version, nil
+	}
+	return http.StatusOK, e.version, nil
+}
+
+// batch runs the operations in order while holding the lock once.
+func (db *database) batch(ops []op) []opResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return applyBatch(db, ops)
+}
+
+// log appends a mutation to the write-ahead log, the caller must hold db.mu.
+func (db *database) log(r walRecord) error {
+	if db.wal == nil {
+		return nil
+	}
+	return db.wal.append(r)
+}
+
+// replay applies a record from the write-ahead log without logging it again.
+// Records the snapshot already contains are skipped, the log is left in place
+// if the process stops between writing a snapshot and truncating the log.
+func (db *database) replay(r walRecord) error {
+	if r.op != walOpTxn && db.contains(r) {
+		return nil
+	}
+	switch r.op {
+	case walOpDelete:
+		if r.version > db.rev {
+			db.rev = r.version
+		}
+		db.remove(r.key, r.version)
+		return nil
+	case walOpTxn:
+		return db.replayTxn(r.records)
+	}
+	if err := db.limits.validate(r.key, r.value); err != nil {
+		return err
+	}
+	if err := db.fits(r.key, r.value); err != nil {
+		return err
+	}
+	if r.version > db.rev {
+		db.rev = r.version
+	}
+	db.set(r.key, db.entryOf(r))
+	return nil
+}
+
+// contains reports if the snapshot loaded before the replay already contains the record.
+// Records of older versions have no version and are always replayed.
+// The caller must hold db.mu.
+func (db *database) contains(r walRecord) bool {
+	return r.version != 0 && r.version <= db.snapshotRev
+}
+
+// entryOf returns the entry written by a put record.
+// Records of older versions have no create revision, it's derived from the current entry then.
+// The caller must hold db.mu.
+func (db *database) entryOf(r walRecord) entry {
+	e := entry{value: r.value, expires: r.expires, version: r.version, created: r.created, content: r.content, times: r.times}
+	if e.created == 0 {
+		e.created = e.version
+		if old, ok := db.db[r.key]; ok {
+			e.created = old.created
+		}
+	}
+	return e
+}
+
+// fits checks if storing value under key stays within the entry and byte limits.
+// The caller must hold db.mu.
+func (db *database) fits(key string, value string) error {
+	if _, ok := db.db[key]; !ok && len(db.db) >= db.limits.Entries {
+		return &DatabaseError{maxLen: db.limits.Entries}
+	}
+	return db.limits.checkBytes(db.sizeAfterPut(key, value))
+}
+
+// makeRoom evicts entries according to the eviction policy until value fits under key.
+// The caller must hold db.mu.
+func (db *database) makeRoom(key string, value string) error {
+	// an entry that doesn't fit into the empty database must not evict anything
+	if err := db.limits.checkBytes(len(key) + len(value)); err != nil {
+		return err
+	}
+	for {
+		err := db.fits(key, value)
+		if err == nil || db.usage == nil {
+			return err
+		}
+		victim, ok := db.usage.victim(key)
+		if !ok {
+			return err
+		}
+		if err := db.removeLogged(victim); err != nil {
+			return err
+		}
+		db.evictions++
+	}
+}
+
+// setEviction sets the eviction policy, existing entries count as used once in key order.
+func (db *database) setEviction(policy evictionPolicy) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.usage = nil
+	if policy == evictReject {
+		return
+	}
+	db.usage = newUsage(policy)
+	keys := make([]string, 0, len(db.db))
+	for key := range db.db {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		db.usage.touch(key)
+	}
+}
+
+// evicted returns the number of entries evicted to make room for new ones.
+func (db *database) evicted() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.evictions
+}
+
+// set stores the entry and keeps track of the size and history, the caller must hold db.mu.
+func (db *database) set(key string, e entry) {
+	db.size = db.sizeAfterPut(key, e.value)
+	if old, ok := db.db[key]; ok {
+		db.record(key, keyRevision{rev: old.version, value: old.value, created: old.created, content: old.content, times: old.times})
+	}
+	db.db[key] = e
+	if db.usage != nil {
+		db.usage.touch(key)
+	}
+	db.shrinkHistory()
+}
+
+// remove deletes the entry at revision rev and keeps track of the size and history.
+// The caller must hold db.mu.
+func (db *database) remove(key string, rev uint64) {
+	if old, ok := db.db[key]; ok {
+		db.size -= len(key) + len(old.value)
+		db.record(key, keyRevision{rev: old.version, value: old.value, created: old.created, content: old.content, times: old.times})
+		db.record(key, keyRevision{rev: rev, deleted: true})
+		delete(db.db, key)
+		if db.usage != nil {
+			db.usage.forget(key)
+		}
+		db.shrinkHistory()
+	}
+}
+
+func (db *database) sizeAfterPut(key string, value string) int {
+	if old, ok := db.db[key]; ok {
+		return db.size - len(old.value) + len(value)
 	}
-	return http.StatusOK, nil
+	return db.size + len(key) + len(value)
 }
 
+// bytes returns the total length of all keys and values.
+func (db *database) bytes() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.size
+}
+
+// snapshot returns all entries sorted by key.
+func (db *database) snapshot() []snapshotEntry {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.entries()
+}
+
+func (db *database) entries() []snapshotEntry {
+	entries := make([]snapshotEntry, 0, len(db.db))
+	for key, e := range db.db {
+		if !db.expired(e) {
+			entries = append(entries, e.toSnapshot(key))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries
+}
+
+// persist atomically replaces the snapshot on disk and keeps the previous ones as backups.
+// A database without a path is only kept in memory.
+// Writes are blocked until the write-ahead log is truncated, so no logged mutation is
+// dropped without being part of the snapshot.
 func (db *database) persist() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	jsonDB, err := json.Marshal(&db)
-	if err != nil {
-		return fmt.Errorf("failed to marshal json: %w", err)
+	if db.path == "" {
+		return nil
 	}
-	err = os.WriteFile("./database.json", jsonDB, filePerm)
+	entries := db.entries()
+	err := writeFileAtomic(db.path, db.backups, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		if err := encodeSnapshot(bw, db.rev, entries); err != nil {
+			return fmt.Errorf("failed to encode snapshot: %w", err)
+		}
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("can't write to file: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("can't write to file: %w", err)
+		return fmt.Errorf("can't persist database: %w", err)
+	}
+	if db.wal != nil {
+		return db.wal.truncate()
+	}
+	return nil
+}
+
+// close persists the database and closes the write-ahead log.
+func (db *database) close() error {
+	if err := db.persist(); err != nil {
+		return err
+	}
+	if db.wal != nil {
+		return db.wal.close()
 	}
 	return nil
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/exp/slog"
+)
+
+func TestLoadDatabase(t *testing.T) {
+	t.Parallel()
+	tooMany := make([]snapshotEntry, 0, defaultMaxEntries+1)
+	for i := 0; i <= defaultMaxEntries; i++ {
+		tooMany = append(tooMany, snapshotEntry{key: fmt.Sprintf("%d", i), value: "v"})
+	}
+	tests := []struct {
+		name    string
+		entries []snapshotEntry
+		raw     string
+		want    int
+		isErr   bool
+	}{
+		{name: "no snapshot", want: 0},
+		{name: "empty snapshot", entries: []snapshotEntry{}, want: 0},
+		{name: "valid snapshot", entries: []snapshotEntry{{key: "a", value: "1"}, {key: "b", value: "2"}}, want: 2},
+		{name: "corrupt snapshot", raw: `{"a":"1","b`, isErr: true},
+		{name: "key too long", entries: []snapshotEntry{{key: "tooooooooooooooolong", value: "1"}}, isErr: true},
+		{name: "value too long", entries: []snapshotEntry{{key: "a", value: strings.Repeat("o", defaultMaxValueLen)}}, isErr: true},
+		{name: "duplicate key", entries: []snapshotEntry{{key: "a", value: "1"}, {key: "a", value: "2"}}, isErr: true},
+		{name: "too many entries", entries: tooMany, isErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			path := filepath.Join(t.TempDir(), "database.snap")
+			switch {
+			case tt.raw != "":
+				is.NoErr(os.WriteFile(path, []byte(tt.raw), filePerm))
+			case tt.entries != nil:
+				writeSnapshot(t, path, tt.entries)
+			}
+			db, err := loadDatabase(path, defaultLimits())
+			if tt.isErr {
+				var snapErr *SnapshotError
+				is.True(errors.As(err, &snapErr))
+				return
+			}
+			is.NoErr(err)
+			is.Equal(len(db.db), tt.want)
+		})
+	}
+}
+
+func TestPersistRestore(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "database.snap")
+	db := newDatabase(path, defaultLimits())
+	_, _, err := db.put("a", "1", putOptions{})
+	is.NoErr(err)
+	_, _, err = db.put("b", "", putOptions{})
+	is.NoErr(err)
+	is.NoErr(db.persist())
+
+	is.NoErr(db.delete("b", precondition{}))
+	is.NoErr(db.persist())
+
+	restored, err := loadDatabase(path, defaultLimits())
+	is.NoErr(err)
+	is.Equal(restored.db, db.db)
+	// the revisions of the deleted key and its delete are not handed out again
+	_, version, err := restored.put("b", "", putOptions{})
+	is.NoErr(err)
+	is.Equal(version, uint64(4))
+}
+
+func TestOpenDatabaseStartEmpty(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	path := filepath.Join(t.TempDir(), "database.snap")
+	is.NoErr(os.WriteFile(path, []byte(`{"a":`), filePerm))
+
+	_, err := openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.True(err != nil)
+
+	db, err := openDatabase(path, defaultLimits(), true, syncAlways, log)
+	is.NoErr(err)
+	defer db.wal.close()
+	is.Equal(len(db.db), 0)
+	_, err = os.Stat(path + ".corrupt")
+	is.NoErr(err)
+}
+
+func writeSnapshot(t *testing.T, path string, entries []snapshotEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encodeSnapshot(&buf, 0, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), filePerm); err != nil {
+		t.Fatal(err)
+	}
+}
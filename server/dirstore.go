@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dirPerm          = 0o700
+	dirFilePrefix    = "k"
+	hashedFilePrefix = "h"
+	// maxDirFileName is the longest encoded name, it leaves room for the ".tmp-<random>"
+	// suffix of temp files, up to 15 bytes, below the 255 byte limit of common file systems
+	maxDirFileName = 240
+)
+
+var (
+	errTrailingData = errors.New("trailing data after record")
+	errKeyMismatch  = errors.New("record holds another key")
+)
+
+// dirStore stores every entry in its own file, so each write is durable on its own.
+// File names are the base64 (url alphabet) encoded keys with a prefix, so the empty key
+// and keys containing path separators map to valid names.
+// Keys whose encoding exceeds maxDirFileName are named by their sha256 hash instead,
+// their names are mapped back to the keys in hashed.
+// A file holds the entry as a single record in the snapshot record format, including its key.
+//
+// Versions are taken from a hybrid clock, the larger of the current time in nanoseconds and
+// the last version plus one, so they keep increasing across restarts without a counter on disk.
+type dirStore struct {
+	mu      sync.Mutex
+	dir     string
+	count   int
+	size    int
+	limits  limits
+	version uint64
+	// expires holds the expiry time of keys with a TTL
+	expires map[string]time.Time
+	// hashed maps the names of the files of long keys to their keys
+	hashed map[string]string
+	now    func() time.Time
+}
+
+// newDirStore opens the store in dir and creates the directory if needed.
+// Leftover temp files of interrupted writes are removed.
+func newDirStore(dir string, l limits) (*dirStore, error) {
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return nil, fmt.Errorf("can't create store directory: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read store directory: %w", err)
+	}
+	s := &dirStore{dir: dir, limits: l, expires: make(map[string]time.Time), hashed: make(map[string]string), now: time.Now}
+	for _, f := range files {
+		key, ok := decodeFileName(f.Name())
+		if !ok && isHashedFileName(f.Name()) {
+			if key, err = s.readKey(f.Name()); err != nil {
+				return nil, err
+			}
+			ok = true
+			s.hashed[f.Name()] = key
+		}
+		if ok {
+			e, _, err := s.read(key)
+			if err != nil {
+				return nil, err
+			}
+			if err := l.validate(key, e.value); err != nil {
+				return nil, fmt.Errorf("entry %q: %w", key, err)
+			}
+			s.count++
+			s.size += len(key) + len(e.value)
+			if e.version > s.version {
+				s.version = e.version
+			}
+			if !e.expires.IsZero() {
+				s.expires[key] = e.expires
+			}
+			continue
+		}
+		if strings.Contains(f.Name(), ".tmp-") {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return nil, fmt.Errorf("can't remove temp file: %w", err)
+			}
+		}
+	}
+	if s.count > l.Entries {
+		return nil, &DatabaseError{maxLen: l.Entries}
+	}
+	if err := l.checkBytes(s.size); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func encodeFileName(key string) string {
+	name := dirFilePrefix + base64.RawURLEncoding.EncodeToString([]byte(key))
+	if len(name) <= maxDirFileName {
+		return name
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hashedFilePrefix + hex.EncodeToString(sum[:])
+}
+
+func isHashedFileName(name string) bool {
+	if len(name) != len(hashedFilePrefix)+2*sha256.Size || !strings.HasPrefix(name, hashedFilePrefix) {
+		return false
+	}
+	_, err := hex.DecodeString(strings.TrimPrefix(name, hashedFilePrefix))
+	return err == nil
+}
+
+func decodeFileName(name string) (string, bool) {
+	if !strings.HasPrefix(name, dirFilePrefix) {
+		return "", false
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(name, dirFilePrefix))
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+func (s *dirStore) path(key string) string {
+	return filepath.Join(s.dir, encodeFileName(key))
+}
+
+// read returns the entry in the file of key, expired entries are returned as well.
+// The caller must hold s.mu, unless the store isn't shared yet.
+func (s *dirStore) read(key string) (entry, bool, error) {
+	b, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return entry{}, false, nil
+	}
+	if err != nil {
+		return entry{}, false, fmt.Errorf("can't read entry: %w", err)
+	}
+	rec, err := parseEntryFile(b)
+	if err == nil && rec.key != key {
+		err = errKeyMismatch
+	}
+	if err != nil {
+		return entry{}, false, fmt.Errorf("entry %q is corrupt: %w", key, err)
+	}
+	e := entry{value: rec.value, expires: rec.expires, version: rec.version, created: rec.created, content: rec.content, times: rec.times}
+	if e.created == 0 {
+		e.created = e.version
+	}
+	return e, true, nil
+}
+
+// readKey returns the key stored in the file name, it's used for the files of long keys.
+func (s *dirStore) readKey(name string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return "", fmt.Errorf("can't read entry: %w", err)
+	}
+	rec, err := parseEntryFile(b)
+	if err == nil && encodeFileName(rec.key) != name {
+		err = errKeyMismatch
+	}
+	if err != nil {
+		return "", fmt.Errorf("file %q is corrupt: %w", name, err)
+	}
+	return rec.key, nil
+}
+
+// parseEntryFile parses the single record of an entry file.
+func parseEntryFile(b []byte) (snapshotEntry, error) {
+	rec, rest, err := parseRecord(b)
+	if err == nil && len(rest) > 0 {
+		err = errTrailingData
+	}
+	return rec, err
+}
+
+// lookup returns the entry of key unless it doesn't exist or has expired.
+// The caller must hold s.mu.
+func (s *dirStore) lookup(key string) (entry, bool, error) {
+	if s.expired(key) {
+		return entry{}, false, nil
+	}
+	return s.read(key)
+}
+
+// expired reports if key has a TTL that has run out, the caller must hold s.mu.
+func (s *dirStore) expired(key string) bool {
+	expires, ok := s.expires[key]
+	return ok && !s.now().Before(expires)
+}
+
+func (s *dirStore) get(key string) (entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getLocked(key)
+}
+
+// getLocked is get for callers that hold s.mu.
+func (s *dirStore) getLocked(key string) (entry, bool, error) {
+	return s.lookup(key)
+}
+
+func (s *dirStore) put(key string, value string, opts putOptions) (int, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putLocked(key, value, opts)
+}
+
+// putLocked is put for callers that hold s.mu.
+func (s *dirStore) putLocked(key string, value string, opts putOptions) (int, uint64, error) {
+	if err := s.limits.validate(key, value); err != nil {
+		return 0, 0, err
+	}
+	old, exists, err := s.read(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	live := exists && !s.expired(key)
+	if !opts.cond.check(old.version, live) {
+		return 0, 0, &PreconditionError{key: key}
+	}
+	if !exists && s.count >= s.limits.Entries {
+		return 0, 0, &DatabaseError{maxLen: s.limits.Entries}
+	}
+	size := s.size + len(key) + len(value)
+	if exists {
+		size = s.size - len(old.value) + len(value)
+	}
+	if err := s.limits.checkBytes(size); err != nil {
+		return 0, 0, err
+	}
+	now := s.now().Round(0)
+	e := entry{value: value, version: s.nextVersion(), content: opts.content, times: times{created: now, modified: now}}
+	e.created = e.version
+	if live {
+		e.created = old.created
+		e.times.created = old.times.created
+	}
+	if opts.ttl > 0 {
+		e.expires = now.Add(opts.ttl)
+	}
+	rec := e.toSnapshot(key)
+	err = writeFileAtomic(s.path(key), 0, func(w io.Writer) error {
+		if _, err := w.Write(appendRecord(nil, rec)); err != nil {
+			return fmt.Errorf("can't write to file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	s.version = e.version
+	s.size = size
+	if e.expires.IsZero() {
+		delete(s.expires, key)
+	} else {
+		s.expires[key] = e.expires
+	}
+	if !exists {
+		s.count++
+		if name := encodeFileName(key); isHashedFileName(name) {
+			s.hashed[name] = key
+		}
+	}
+	if live {
+		return http.StatusOK, e.version, nil
+	}
+	return http.StatusCreated, e.version, nil
+}
+
+// nextVersion returns a version larger than all previous ones, the caller must hold s.mu.
+func (s *dirStore) nextVersion() uint64 {
+	v := uint64(s.now().UnixNano())
+	if v <= s.version {
+		v = s.version + 1
+	}
+	return v
+}
+
+func (s *dirStore) delete(key string, cond precondition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteLocked(key, cond)
+}
+
+// deleteLocked is delete for callers that hold s.mu.
+func (s *dirStore) deleteLocked(key string, cond precondition) error {
+	e, ok, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	if !cond.check(e.version, ok) {
+		return &PreconditionError{key: key}
+	}
+	if !ok {
+		return &NoEntryError{key: key}
+	}
+	return s.remove(key)
+}
+
+// batch runs the operations in order while holding the lock once.
+func (s *dirStore) batch(ops []op) []opResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return applyBatch(s, ops)
+}
+
+// remove deletes the file of key, the caller must hold s.mu.
+func (s *dirStore) remove(key string) error {
+	e, ok, err := s.read(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &NoEntryError{key: key}
+	}
+	if err := os.Remove(s.path(key)); err != nil {
+		return fmt.Errorf("can't delete file: %w", err)
+	}
+	s.count--
+	s.size -= len(key) + len(e.value)
+	delete(s.expires, key)
+	delete(s.hashed, encodeFileName(key))
+	return syncDir(s.dir)
+}
+
+func (s *dirStore) reap() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key := range s.expires {
+		if s.expired(key) && s.remove(key) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *dirStore) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys()
+}
+
+func (s *dirStore) scan(opts scanOptions) (scanPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for _, key := range s.keys() {
+		if opts.match(key) {
+			keys = append(keys, key)
+		}
+	}
+	keys, page := paginate(keys, opts.limit)
+	for _, key := range keys {
+		rec := snapshotEntry{key: key}
+		if opts.values {
+			e, ok, err := s.lookup(key)
+			if err != nil {
+				return scanPage{}, err
+			}
+			if !ok {
+				continue
+			}
+			rec.value, rec.expires, rec.version = e.value, e.expires, e.version
+		}
+		page.entries = append(page.entries, rec)
+	}
+	return page, nil
+}
+
+func (s *dirStore) keys() []string {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(files))
+	for _, f := range files {
+		if key, ok := s.keyOf(f.Name()); ok && !s.expired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keyOf returns the key of the file name, the caller must hold s.mu.
+func (s *dirStore) keyOf(name string) (string, bool) {
+	if key, ok := s.hashed[name]; ok {
+		return key, true
+	}
+	return decodeFileName(name)
+}
+
+func (s *dirStore) snapshot() []snapshotEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.keys()
+	entries := make([]snapshotEntry, 0, len(keys))
+	for _, key := range keys {
+		// unreadable entries are left out, get and scan report them
+		e, ok, err := s.lookup(key)
+		if err != nil || !ok {
+			continue
+		}
+		entries = append(entries, e.toSnapshot(key))
+	}
+	return entries
+}
+
+func (s *dirStore) bytes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *dirStore) close() error {
+	return nil
+}
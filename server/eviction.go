@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+)
+
+// evictionPolicy decides which entry makes room when the database is full.
+type evictionPolicy string
+
+const (
+	// evictReject rejects writes to a full database.
+	evictReject evictionPolicy = "reject"
+	// evictLRU evicts the least recently used entry.
+	evictLRU evictionPolicy = "lru"
+	// evictLFU evicts the least frequently used entry, ties are broken by the least recently used.
+	evictLFU evictionPolicy = "lfu"
+	// evictRandom evicts a random entry.
+	evictRandom evictionPolicy = "random"
+)
+
+func parseEvictionPolicy(s string) (evictionPolicy, error) {
+	switch p := evictionPolicy(s); p {
+	case evictReject, evictLRU, evictLFU, evictRandom:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown eviction policy %q, use either 'reject', 'lru', 'lfu' or 'random'", s)
+}
+
+type usageItem struct {
+	key   string
+	hits  uint64
+	tick  uint64
+	index int
+}
+
+// usage tracks how entries are accessed, the root of the heap is the next entry to evict.
+// It is not safe for concurrent use, the database guards it with its mutex.
+type usage struct {
+	policy evictionPolicy
+	items  []*usageItem
+	byKey  map[string]*usageItem
+	tick   uint64
+}
+
+func newUsage(policy evictionPolicy) *usage {
+	return &usage{policy: policy, byKey: make(map[string]*usageItem)}
+}
+
+// touch records an access of key and starts tracking it if needed.
+func (u *usage) touch(key string) {
+	u.tick++
+	item, ok := u.byKey[key]
+	if !ok {
+		item = &usageItem{key: key}
+		u.byKey[key] = item
+		item.hits, item.tick = 1, u.tick
+		heap.Push(u, item)
+		return
+	}
+	item.hits++
+	item.tick = u.tick
+	heap.Fix(u, item.index)
+}
+
+func (u *usage) forget(key string) {
+	item, ok := u.byKey[key]
+	if !ok {
+		return
+	}
+	heap.Remove(u, item.index)
+	delete(u.byKey, key)
+}
+
+// victim returns the entry to evict next that is not keep.
+func (u *usage) victim(keep string) (string, bool) {
+	if len(u.items) == 0 {
+		return "", false
+	}
+	if u.policy == evictRandom {
+		for {
+			item := u.items[rand.Intn(len(u.items))] //nolint:gosec
+			if item.key != keep || len(u.items) == 1 {
+				return item.key, item.key != keep
+			}
+		}
+	}
+	if root := u.items[0]; root.key != keep {
+		return root.key, true
+	}
+	// keep is the root, the next candidate is one of its children
+	var next *usageItem
+	for _, i := range []int{1, 2} { //nolint:gomnd
+		if i < len(u.items) && (next == nil || u.Less(i, next.index)) {
+			next = u.items[i]
+		}
+	}
+	if next == nil {
+		return "", false
+	}
+	return next.key, true
+}
+
+func (u *usage) Len() int { return len(u.items) }
+
+func (u *usage) Less(i, j int) bool {
+	a, b := u.items[i], u.items[j]
+	if u.policy == evictLFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.tick < b.tick
+}
+
+func (u *usage) Swap(i, j int) {
+	u.items[i], u.items[j] = u.items[j], u.items[i]
+	u.items[i].index = i
+	u.items[j].index = j
+}
+
+func (u *usage) Push(x any) {
+	item := x.(*usageItem) //nolint:forcetypeassert
+	item.index = len(u.items)
+	u.items = append(u.items, item)
+}
+
+func (u *usage) Pop() any {
+	n := len(u.items)
+	item := u.items[n-1]
+	u.items[n-1] = nil
+	u.items = u.items[:n-1]
+	return item
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func newEvictingDatabase(policy evictionPolicy, entries int) *database {
+	l := defaultLimits()
+	l.Entries = entries
+	db := newDatabase("", l)
+	db.setEviction(policy)
+	return db
+}
+
+func TestEvictionOrder(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		policy evictionPolicy
+		gets   []string
+		want   []string
+	}{
+		// a, b and c are put in order, then gets are made and d and e are put
+		{name: "lru", policy: evictLRU, gets: []string{"a"}, want: []string{"a", "d", "e"}},
+		{name: "lru repeated", policy: evictLRU, gets: []string{"a", "b", "a"}, want: []string{"a", "d", "e"}},
+		{name: "lfu", policy: evictLFU, gets: []string{"c", "c", "b"}, want: []string{"b", "c", "e"}},
+		{name: "lfu ties by recency", policy: evictLFU, gets: []string{"b", "a"}, want: []string{"a", "b", "e"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			db := newEvictingDatabase(tt.policy, 3)
+			for _, key := range []string{"a", "b", "c"} {
+				_, _, err := db.put(key, "v", putOptions{})
+				is.NoErr(err)
+			}
+			for _, key := range tt.gets {
+				_, ok, _ := db.get(key)
+				is.True(ok)
+			}
+			for _, key := range []string{"d", "e"} {
+				_, _, err := db.put(key, "v", putOptions{})
+				is.NoErr(err)
+			}
+			is.Equal(db.list(), tt.want)
+			is.Equal(db.evicted(), uint64(2))
+		})
+	}
+}
+
+func TestEvictionRandom(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	db := newEvictingDatabase(evictRandom, 10)
+	for i := 0; i < 100; i++ {
+		_, _, err := db.put(strconv.Itoa(i), "v", putOptions{})
+		is.NoErr(err)
+		_, ok, _ := db.get(strconv.Itoa(i))
+		is.True(ok) // the written key is never evicted
+	}
+	is.Equal(len(db.list()), 10)
+	is.Equal(db.evicted(), uint64(90))
+}
+
+func TestEvictionReject(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	db := newEvictingDatabase(evictReject, 1)
+	_, _, err := db.put("a", "v", putOptions{})
+	is.NoErr(err)
+	_, _, err = db.put("a", "overwrite", putOptions{})
+	is.NoErr(err)
+	var dbErr *DatabaseError
+	_, _, err = db.put("b", "v", putOptions{})
+	is.True(errors.As(err, &dbErr))
+	is.Equal(db.evicted(), uint64(0))
+}
+
+func TestEvictionBytes(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	db := newEvictingDatabase(evictLRU, 100)
+	db.limits.Bytes = 6
+	for _, key := range []string{"a", "b", "c"} {
+		_, _, err := db.put(key, "v", putOptions{})
+		is.NoErr(err)
+	}
+	_, _, err := db.put("d", "vvv", putOptions{})
+	is.NoErr(err)
+	is.Equal(db.list(), []string{"c", "d"})
+
+	// a value that can never fit evicts nothing
+	var quotaErr *QuotaError
+	_, _, err = db.put("e", "vvvvvvv", putOptions{})
+	is.True(errors.As(err, &quotaErr))
+	is.Equal(db.list(), []string{"c", "d"})
+}
+
+func TestEvictionParallel(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []evictionPolicy{evictLRU, evictLFU, evictRandom} {
+		policy := policy
+		t.Run(string(policy), func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			const capacity, writers, puts = 50, 8, 100
+			db := newEvictingDatabase(policy, capacity)
+			// the hot key is read before every write, LRU and LFU never evict it
+			_, _, err := db.put("hot", "v", putOptions{})
+			is.NoErr(err)
+
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				w := w
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < puts; i++ {
+						db.get("hot")
+						if _, _, err := db.put(fmt.Sprintf("%d-%d", w, i), "v", putOptions{}); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			is.Equal(len(db.list()), capacity)
+			is.Equal(db.evicted(), uint64(writers*puts+1-capacity))
+			is.Equal(len(db.usage.items), capacity)
+			if policy != evictRandom {
+				_, ok, _ := db.get("hot")
+				is.True(ok)
+			}
+		})
+	}
+}
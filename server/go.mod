@@ -1,6 +1,6 @@
 module github.com/jonas27/rampu-up-go/server
 
-go 1.20
+go 1.22
 
 require (
 	github.com/matryer/is v1.4.1
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultHistory is the number of previous writes kept per key.
+	defaultHistory = 10
+	// minHistoryOrder is the length of the queue of the history before it is compacted the first time
+	minHistoryOrder = 64
+)
+
+// keyRevision is a write of a key, either a value or a delete.
+// It doesn't record the token that made the write.
+type keyRevision struct {
+	rev     uint64
+	value   string
+	created uint64
+	content content
+	times   times
+	deleted bool
+}
+
+// keyHistory holds the previous writes of a key, oldest first.
+type keyHistory struct {
+	revs []keyRevision
+	// truncated is set once older writes were dropped
+	truncated bool
+}
+
+// tombstone marks the delete of a key at a revision.
+type tombstone struct {
+	key string
+	rev uint64
+}
+
+// historyRef is a revision of a key in the history.
+type historyRef struct {
+	key string
+	rev uint64
+}
+
+// FutureRevisionError is returned for a read at a revision that doesn't exist yet.
+type FutureRevisionError struct {
+	rev     uint64
+	current uint64
+}
+
+func (e *FutureRevisionError) Error() string {
+	return fmt.Sprintf("error: revision %d is newer than the current revision %d", e.rev, e.current)
+}
+
+// record appends a write to the history of key and drops the oldest writes beyond the limits.
+// The histories of at most limits.Entries deleted keys are kept. The caller must hold db.mu.
+func (db *database) record(key string, r keyRevision) {
+	if db.historyLen <= 0 {
+		return
+	}
+	h, ok := db.history[key]
+	if !ok {
+		h = &keyHistory{}
+		db.history[key] = h
+	}
+	h.revs = append(h.revs, r)
+	db.historyBytes += revisionSize(key, r)
+	if db.limits.Bytes > 0 {
+		db.enqueue(historyRef{key: key, rev: r.rev})
+	}
+	if len(h.revs) > db.historyLen {
+		db.dropOldest(key, h, len(h.revs)-db.historyLen)
+	}
+	if !r.deleted {
+		return
+	}
+	db.graves = append(db.graves, tombstone{key: key, rev: r.rev})
+	for len(db.graves) > db.limits.Entries {
+		db.bury(db.graves[0])
+		db.graves = db.graves[1:]
+	}
+}
+
+// setHistory changes the number of previous writes kept per key and trims the histories.
+func (db *database) setHistory(n int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.historyLen = n
+	for key, h := range db.history {
+		if n <= 0 {
+			delete(db.history, key)
+			continue
+		}
+		if len(h.revs) > n {
+			db.dropOldest(key, h, len(h.revs)-n)
+		}
+	}
+	if n <= 0 {
+		db.graves = nil
+		db.historyBytes = 0
+		db.historyOrder = nil
+	}
+}
+
+// revisionSize is the size of a revision in the history, counted like an entry.
+func revisionSize(key string, r keyRevision) int {
+	return len(key) + len(r.value)
+}
+
+// dropOldest drops the n oldest writes of the history h of key, at least one is kept.
+// The caller must hold db.mu.
+func (db *database) dropOldest(key string, h *keyHistory, n int) {
+	for _, r := range h.revs[:n] {
+		db.historyBytes -= revisionSize(key, r)
+	}
+	h.revs = append(h.revs[:0:0], h.revs[n:]...)
+	h.truncated = true
+}
+
+// forget drops the whole history of key, the caller must hold db.mu.
+func (db *database) forget(key string, h *keyHistory) {
+	for _, r := range h.revs {
+		db.historyBytes -= revisionSize(key, r)
+	}
+	delete(db.history, key)
+}
+
+// enqueue appends a write to the queue shrinkHistory drops the oldest writes from.
+// The queue is compacted once most of it refers to writes that were dropped otherwise.
+// The caller must hold db.mu.
+func (db *database) enqueue(ref historyRef) {
+	db.historyOrder = append(db.historyOrder, ref)
+	if len(db.historyOrder) < db.historyOrderMax {
+		return
+	}
+	kept := make([]historyRef, 0, len(db.historyOrder))
+	for _, ref := range db.historyOrder {
+		if h, ok := db.history[ref.key]; ok && ref.rev >= h.revs[0].rev {
+			kept = append(kept, ref)
+		}
+	}
+	db.historyOrder = kept
+	db.historyOrderMax = 2*len(kept) + minHistoryOrder
+}
+
+// shrinkHistory drops the oldest writes of all keys until the entries and the history
+// fit into limits.Bytes together, so the history only uses the bytes the entries leave free.
+// The caller must hold db.mu.
+func (db *database) shrinkHistory() {
+	for db.limits.Bytes > 0 && db.size+db.historyBytes > db.limits.Bytes && len(db.historyOrder) > 0 {
+		ref := db.historyOrder[0]
+		db.historyOrder = db.historyOrder[1:]
+		h, ok := db.history[ref.key]
+		if !ok || h.revs[0].rev != ref.rev {
+			continue // dropped otherwise
+		}
+		if len(h.revs) > 1 {
+			db.dropOldest(ref.key, h, 1)
+			continue
+		}
+		db.forget(ref.key, h)
+		// reads before the next write of the key can't tell anymore what it was
+		next := ref.rev
+		if e, ok := db.db[ref.key]; ok {
+			next = e.version
+		}
+		if next > db.historyFloor {
+			db.historyFloor = next
+		}
+	}
+}
+
+// bury drops the history of a key that is still deleted, the caller must hold db.mu.
+func (db *database) bury(t tombstone) {
+	if _, ok := db.db[t.key]; ok {
+		return
+	}
+	h, ok := db.history[t.key]
+	if !ok || h.revs[len(h.revs)-1].rev != t.rev {
+		return
+	}
+	db.forget(t.key, h)
+	// reads before the delete can't tell anymore if the key existed
+	if t.rev > db.historyFloor {
+		db.historyFloor = t.rev
+	}
+}
+
+// getAt returns the entry of key as of revision rev.
+// As of reads ignore the TTL, an entry expires at the revision the reaper removes it.
+func (db *database) getAt(key string, rev uint64) (entry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if rev > db.rev {
+		return entry{}, &FutureRevisionError{rev: rev, current: db.rev}
+	}
+	if e, ok := db.db[key]; ok && e.version <= rev {
+		return e, nil
+	}
+	h := db.history[key]
+	if h != nil {
+		for i := len(h.revs) - 1; i >= 0; i-- {
+			r := h.revs[i]
+			if r.rev > rev {
+				continue
+			}
+			if r.deleted {
+				return entry{}, &NoEntryError{key: key}
+			}
+			return entry{value: r.value, version: r.rev, created: r.created, content: r.content, times: r.times}, nil
+		}
+	}
+	switch {
+	case db.historyLen <= 0:
+		return entry{}, &CompactedError{rev: rev, floor: db.rev}
+	case h != nil && h.truncated:
+		return entry{}, &CompactedError{rev: rev, floor: h.revs[0].rev}
+	case rev < db.historyFloor:
+		return entry{}, &CompactedError{rev: rev, floor: db.historyFloor}
+	}
+	return entry{}, &NoEntryError{key: key}
+}
+
+// revisions returns the known writes of key, oldest first, the last one is the current entry
+// if the key exists. truncated reports if older writes were dropped.
+func (db *database) revisions(key string) ([]keyRevision, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var revs []keyRevision
+	truncated := false
+	if h, ok := db.history[key]; ok {
+		revs = append(revs, h.revs...)
+		truncated = h.truncated
+	}
+	if e, ok := db.db[key]; ok {
+		revs = append(revs, keyRevision{rev: e.version, value: e.value, created: e.created, content: e.content, times: e.times})
+	}
+	if len(revs) == 0 {
+		return nil, false, &NoEntryError{key: key}
+	}
+	return revs, truncated || revs[0].rev < db.historyFloor, nil
+}
+
+// parseRevision reads the optional rev query parameter of a GET.
+func parseRevision(r *http.Request) (uint64, error) {
+	v := r.URL.Query().Get("rev")
+	if v == "" {
+		return 0, nil
+	}
+	rev, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || rev == 0 {
+		return 0, fmt.Errorf("error: rev %q is not a revision", v) //nolint:goerr113
+	}
+	return rev, nil
+}
+
+type revisionItem struct {
+	Revision       uint64  `json:"revision"`
+	Value          *string `json:"value,omitempty"`
+	Encoding       string  `json:"encoding,omitempty"`
+	CreateRevision uint64  `json:"createRevision,omitempty"`
+	Deleted        bool    `json:"deleted,omitempty"`
+}
+
+type historyResponse struct {
+	Key       string         `json:"key"`
+	Revisions []revisionItem `json:"revisions"`
+	// Truncated is set if older writes of the key were dropped
+	Truncated bool `json:"truncated"`
+}
+
+// handleHistory lists the known writes of a key, oldest first.
+func (s *server) handleHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hs, ok := s.store(r).(historian)
+		if !ok {
+			s.writeError(w, r, &UnsupportedError{feature: "history"})
+			return
+		}
+		key := r.URL.Query().Get("key")
+		if err := s.authorize(r, key, permRead); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		revs, truncated, err := hs.revisions(key)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		resp := historyResponse{Key: key, Revisions: make([]revisionItem, 0, len(revs)), Truncated: truncated}
+		for _, rev := range revs {
+			item := revisionItem{Revision: rev.rev, CreateRevision: rev.created, Deleted: rev.deleted}
+			if !rev.deleted {
+				item.Value, item.Encoding = jsonValue(rev.value)
+			}
+			resp.Revisions = append(resp.Revisions, item)
+		}
+		w.Header().Set("Content-Type", jsonMediaType)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			s.log.Info("Error writing response", "error", err)
+		}
+	}
+}
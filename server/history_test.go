@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestGetAt(t *testing.T) {
+	t.Parallel()
+	// the clock is at the revision of a write in seconds
+	at := func(created, modified int64) times {
+		return times{created: time.Unix(created, 0), modified: time.Unix(modified, 0)}
+	}
+	tests := []struct {
+		name       string
+		key        string
+		rev        uint64
+		historyLen int
+		want       entry
+		err        error
+	}{
+		{name: "current", key: "a", rev: 5, historyLen: 10, want: entry{value: "3", version: 4, created: 1, times: at(1, 4)}},
+		{name: "previous", key: "a", rev: 2, historyLen: 10, want: entry{value: "2", version: 2, created: 1, times: at(1, 2)}},
+		{name: "first", key: "a", rev: 1, historyLen: 10, want: entry{value: "1", version: 1, created: 1, times: at(1, 1)}},
+		{name: "before create", key: "b", rev: 2, historyLen: 10, err: &NoEntryError{}},
+		{name: "deleted", key: "b", rev: 5, historyLen: 10, err: &NoEntryError{}},
+		{name: "before delete", key: "b", rev: 4, historyLen: 10, want: entry{value: "b", version: 3, created: 3, times: at(3, 3)}},
+		{name: "trimmed", key: "a", rev: 1, historyLen: 1, err: &CompactedError{}},
+		{name: "trimmed kept", key: "a", rev: 2, historyLen: 1, want: entry{value: "2", version: 2, created: 1, times: at(1, 2)}},
+		{name: "no history", key: "a", rev: 2, historyLen: 0, err: &CompactedError{}},
+		{name: "future", key: "a", rev: 6, historyLen: 10, err: &FutureRevisionError{}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			db := newDatabase("", defaultLimits())
+			db.historyLen = tt.historyLen
+			clock := &fakeClock{}
+			db.now = clock.now
+			for i, kv := range [][2]string{{"a", "1"}, {"a", "2"}, {"b", "b"}, {"a", "3"}} {
+				clock.t = time.Unix(int64(i+1), 0)
+				_, _, err := db.put(kv[0], kv[1], putOptions{})
+				is.NoErr(err)
+			}
+			is.NoErr(db.delete("b", precondition{}))
+
+			e, err := db.getAt(tt.key, tt.rev)
+			switch want := tt.err.(type) {
+			case nil:
+				is.NoErr(err)
+				is.Equal(e, tt.want)
+			case *NoEntryError:
+				is.True(errors.As(err, &want))
+			case *CompactedError:
+				is.True(errors.As(err, &want))
+			case *FutureRevisionError:
+				is.True(errors.As(err, &want))
+			}
+		})
+	}
+}
+
+func TestCreateRevision(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	db := newDatabase("", defaultLimits())
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	db.now = clock.now
+	_, _, err := db.put("a", "1", putOptions{})
+	is.NoErr(err)
+	clock.t = clock.t.Add(time.Second)
+	_, _, err = db.put("a", "2", putOptions{})
+	is.NoErr(err)
+	e, _, _ := db.get("a")
+	// an update keeps the create revision and time
+	is.Equal(e, entry{value: "2", version: 2, created: 1, times: times{created: time.Unix(1000, 0), modified: time.Unix(1001, 0)}})
+
+	is.NoErr(db.delete("a", precondition{}))
+	_, _, err = db.put("a", "3", putOptions{})
+	is.NoErr(err)
+	e, _, _ = db.get("a")
+	// a recreated key starts over
+	is.Equal(e, entry{value: "3", version: 4, created: 4, times: times{created: time.Unix(1001, 0), modified: time.Unix(1001, 0)}})
+}
+
+func TestHistoryBuried(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	l := defaultLimits()
+	l.Entries = 1
+	db := newDatabase("", l)
+	for _, key := range []string{"a", "b"} {
+		_, _, err := db.put(key, key, putOptions{})
+		is.NoErr(err)
+		is.NoErr(db.delete(key, precondition{}))
+	}
+	// only the history of the last deleted key is kept
+	_, ok := db.history["a"]
+	is.True(!ok)
+	var compactedErr *CompactedError
+	_, err := db.getAt("a", 1)
+	is.True(errors.As(err, &compactedErr))
+	e, err := db.getAt("b", 3)
+	is.NoErr(err)
+	is.Equal(e.value, "b")
+}
+
+func TestHistoryBytes(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	l := defaultLimits()
+	l.Bytes = 20
+	db := newDatabase("", l)
+	for _, kv := range [][2]string{{"a", "1234"}, {"a", "5678"}, {"b", "123456789"}} {
+		_, _, err := db.put(kv[0], kv[1], putOptions{})
+		is.NoErr(err)
+	}
+	// the history uses the bytes the entries leave free
+	e, err := db.getAt("a", 1)
+	is.NoErr(err)
+	is.Equal(e.value, "1234")
+	is.Equal(db.size+db.historyBytes, 20)
+
+	// the oldest writes of all keys are dropped first
+	_, _, err = db.put("b", "1234567890", putOptions{})
+	is.NoErr(err)
+	is.Equal(db.historyBytes, 0)
+	var compactedErr *CompactedError
+	_, err = db.getAt("a", 1)
+	is.True(errors.As(err, &compactedErr))
+	_, _, err = db.put("a", "x", putOptions{})
+	is.NoErr(err)
+	e, err = db.getAt("a", 4)
+	is.NoErr(err)
+	is.Equal(e.value, "5678")
+	is.True(db.size+db.historyBytes <= l.Bytes)
+
+	// the queue of the history doesn't grow with writes that were dropped by the per key limit
+	l.Bytes = 1 << 20
+	db = newDatabase("", l)
+	for i := 0; i < 1000; i++ {
+		_, _, err := db.put("c", "1", putOptions{})
+		is.NoErr(err)
+	}
+	is.True(len(db.historyOrder) < 2*minHistoryOrder)
+}
+
+func TestHandleGetRevision(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		query   string
+		code    int
+		want    string
+		created string
+	}{
+		{name: "current", query: "?key=a", code: http.StatusOK, want: "2", created: "1"},
+		{name: "as of", query: "?key=a&rev=1", code: http.StatusOK, want: "1", created: "1"},
+		{name: "deleted", query: "?key=b&rev=4", code: http.StatusNotFound},
+		{name: "future", query: "?key=a&rev=9", code: http.StatusBadRequest},
+		{name: "invalid", query: "?key=a&rev=x", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{})
+			for _, kv := range [][2]string{{"a", "1"}, {"a", "2"}, {"b", "b"}} {
+				_, _, err := s.db.put(kv[0], kv[1], putOptions{})
+				is.NoErr(err)
+			}
+			is.NoErr(s.db.delete("b", precondition{}))
+
+			req := httptest.NewRequest(http.MethodGet, "/db"+tt.query, nil)
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			is.Equal(w.Body.String(), tt.want)
+			is.Equal(w.Header().Get("X-Create-Revision"), tt.created)
+		})
+	}
+}
+
+func TestHandleHistory(t *testing.T) {
+	t.Parallel()
+	value := func(v string) *string { return &v }
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		want  historyResponse
+	}{
+		{
+			name:  "recreated",
+			query: "?key=a",
+			code:  http.StatusOK,
+			want: historyResponse{Key: "a", Revisions: []revisionItem{
+				{Revision: 1, Value: value("1"), CreateRevision: 1},
+				{Revision: 2, Deleted: true},
+				{Revision: 3, Value: value("2"), CreateRevision: 3},
+			}},
+		},
+		{
+			name:  "deleted",
+			query: "?key=b",
+			code:  http.StatusOK,
+			want: historyResponse{Key: "b", Revisions: []revisionItem{
+				{Revision: 4, Value: value("b"), CreateRevision: 4},
+				{Revision: 5, Deleted: true},
+			}},
+		},
+		{name: "unknown", query: "?key=c", code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{})
+			_, _, err := s.db.put("a", "1", putOptions{})
+			is.NoErr(err)
+			is.NoErr(s.db.delete("a", precondition{}))
+			_, _, err = s.db.put("a", "2", putOptions{})
+			is.NoErr(err)
+			_, _, err = s.db.put("b", "b", putOptions{})
+			is.NoErr(err)
+			is.NoErr(s.db.delete("b", precondition{}))
+
+			req := httptest.NewRequest(http.MethodGet, "/history"+tt.query, nil)
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			var resp historyResponse
+			is.NoErr(json.NewDecoder(w.Body).Decode(&resp))
+			is.Equal(resp, tt.want)
+		})
+	}
+}
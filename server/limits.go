@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	defaultMaxKeyLen   = 20
+	defaultMaxValueLen = 200
+	defaultMaxEntries  = 2000
+
+	envMaxKeyLen   = "RAMPUP_MAX_KEY_LEN"
+	envMaxValueLen = "RAMPUP_MAX_VALUE_LEN"
+	envMaxEntries  = "RAMPUP_MAX_ENTRIES"
+	envMaxBytes    = "RAMPUP_MAX_BYTES"
+)
+
+var errInvalidLimit = errors.New("limits must be positive, the byte quota may be 0")
+
+// limits bound the size of the database.
+// Keys and values must be shorter than KeyLen and ValueLen, and there are at most Entries entries.
+// Bytes caps the total length of all keys and values, 0 means no cap.
+type limits struct {
+	KeyLen   int `json:"maxKeyLen"`
+	ValueLen int `json:"maxValueLen"`
+	Entries  int `json:"maxEntries"`
+	Bytes    int `json:"maxBytes"`
+}
+
+func defaultLimits() limits {
+	return limits{KeyLen: defaultMaxKeyLen, ValueLen: defaultMaxValueLen, Entries: defaultMaxEntries}
+}
+
+func (l limits) validate(key string, value string) error {
+	if len(key) >= l.KeyLen {
+		return &KeyError{maxLen: l.KeyLen}
+	}
+	if len(value) >= l.ValueLen {
+		return &ValueError{maxLen: l.ValueLen}
+	}
+	return nil
+}
+
+func (l limits) checkBytes(size int) error {
+	if l.Bytes > 0 && size > l.Bytes {
+		return &QuotaError{maxBytes: l.Bytes}
+	}
+	return nil
+}
+
+func (l limits) check() error {
+	if l.KeyLen <= 0 || l.ValueLen <= 0 || l.Entries <= 0 || l.Bytes < 0 {
+		return fmt.Errorf("%w: %+v", errInvalidLimit, l)
+	}
+	return nil
+}
+
+// limitFlags holds the flags that override the limits.
+type limitFlags struct {
+	config   *string
+	keyLen   *int
+	valueLen *int
+	entries  *int
+	bytes    *int
+}
+
+func registerLimitFlags(flags *flag.FlagSet) limitFlags {
+	return limitFlags{
+		config:   flags.String("config", "", "A JSON file with the limits maxKeyLen, maxValueLen, maxEntries and maxBytes"),
+		keyLen:   flags.Int("max-key-len", defaultMaxKeyLen, "Keys must be shorter than this, overrides "+envMaxKeyLen),
+		valueLen: flags.Int("max-value-len", defaultMaxValueLen, "Values must be shorter than this, overrides "+envMaxValueLen),
+		entries:  flags.Int("max-entries", defaultMaxEntries, "The maximum number of entries, overrides "+envMaxEntries),
+		bytes:    flags.Int("max-bytes", 0, "The maximum total size of keys and values, 0 for no cap, overrides "+envMaxBytes),
+	}
+}
+
+// resolve returns the limits with defaults overridden by the config file,
+// then by environment variables and finally by flags set on the command line.
+func (lf limitFlags) resolve(flags *flag.FlagSet, lookupEnv func(string) (string, bool)) (limits, error) {
+	l := defaultLimits()
+	if *lf.config != "" {
+		b, err := os.ReadFile(*lf.config)
+		if err != nil {
+			return l, fmt.Errorf("can't read config: %w", err)
+		}
+		if err := json.Unmarshal(b, &l); err != nil {
+			return l, fmt.Errorf("can't parse config %q: %w", *lf.config, err)
+		}
+	}
+	for name, limit := range map[string]*int{
+		envMaxKeyLen: &l.KeyLen, envMaxValueLen: &l.ValueLen, envMaxEntries: &l.Entries, envMaxBytes: &l.Bytes,
+	} {
+		s, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return l, fmt.Errorf("can't parse %s: %w", name, err)
+		}
+		*limit = v
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "max-key-len":
+			l.KeyLen = *lf.keyLen
+		case "max-value-len":
+			l.ValueLen = *lf.valueLen
+		case "max-entries":
+			l.Entries = *lf.entries
+		case "max-bytes":
+			l.Bytes = *lf.bytes
+		}
+	})
+	return l, l.check()
+}
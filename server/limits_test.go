@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestResolveLimits(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		args   []string
+		config string
+		env    map[string]string
+		want   limits
+		isErr  bool
+	}{
+		{name: "defaults", want: defaultLimits()},
+		{
+			name:   "config file",
+			config: `{"maxKeyLen": 100, "maxValueLen": 1000}`,
+			want:   limits{KeyLen: 100, ValueLen: 1000, Entries: defaultMaxEntries},
+		},
+		{
+			name:   "env overrides config",
+			config: `{"maxKeyLen": 100}`,
+			env:    map[string]string{envMaxKeyLen: "50", envMaxEntries: "10"},
+			want:   limits{KeyLen: 50, ValueLen: defaultMaxValueLen, Entries: 10},
+		},
+		{
+			name: "flags override env",
+			args: []string{"-max-key-len", "30"},
+			env:  map[string]string{envMaxKeyLen: "50"},
+			want: limits{KeyLen: 30, ValueLen: defaultMaxValueLen, Entries: defaultMaxEntries},
+		},
+		{name: "invalid env", env: map[string]string{envMaxValueLen: "big"}, isErr: true},
+		{name: "invalid config", config: `{"maxKeyLen":`, isErr: true},
+		{name: "not positive", args: []string{"-max-entries", "0"}, isErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			args := tt.args
+			if tt.config != "" {
+				path := filepath.Join(t.TempDir(), "config.json")
+				is.NoErr(os.WriteFile(path, []byte(tt.config), filePerm))
+				args = append([]string{"-config", path}, args...)
+			}
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			lf := registerLimitFlags(flags)
+			is.NoErr(flags.Parse(args))
+			l, err := lf.resolve(flags, func(name string) (string, bool) {
+				v, ok := tt.env[name]
+				return v, ok
+			})
+			if tt.isErr {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(l, tt.want)
+		})
+	}
+}
+
+func TestLoadDatabaseLowerLimits(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "database.snap")
+	writeSnapshot(t, path, []snapshotEntry{{key: "a", value: "1"}, {key: "b", value: "2"}})
+
+	_, err := loadDatabase(path, limits{KeyLen: 10, ValueLen: 10, Entries: 1})
+	is.True(err != nil)
+	db, err := loadDatabase(path, limits{KeyLen: 10, ValueLen: 10, Entries: 2})
+	is.NoErr(err)
+	is.Equal(len(db.db), 2)
+}
+
+func TestHandleLimits(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	s := testServer(map[string]string{})
+	req := httptest.NewRequest(http.MethodGet, "/limits", nil)
+	w := httptest.NewRecorder()
+	s.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(w.Header().Get("Content-Type"), "application/json")
+	var l limits
+	is.NoErr(json.NewDecoder(w.Body).Decode(&l))
+	is.Equal(l, defaultLimits())
+}
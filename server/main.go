@@ -5,9 +5,12 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -20,6 +23,7 @@ const (
 	exitFail             = 1
 	serverTimeoutSeconds = 3
 	tickerSeconds        = 100
+	reapSeconds          = 1
 )
 
 func main() {
@@ -34,34 +38,133 @@ func main() {
 func run(args []string, log *slog.Logger) error { //nolint:cyclop,funlen
 	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
 	addr := flags.String("addr", ":8080", "The server addr with colon")
+	dbFile := flags.String("db-file", "./database.snap", "The file the database is persisted to and restored from")
+	startEmpty := flags.Bool("start-empty", false, "Start with an empty database if the snapshot is unusable, or with the snapshot alone if the write-ahead log is")
+	dbBackups := flags.Int("db-backups", snapshotBackups, "The number of previous snapshots kept as <db-file>.1 to <db-file>.N")
+	walSync := flags.String("wal-sync", "always", "When to fsync the write-ahead log: 'always', 'never' or an interval like '100ms'")
+	storeKind := flags.String("store", "memory", "The storage backend: 'memory' (snapshot and write-ahead log) or 'dir' (file per key)")
+	storeDir := flags.String("store-dir", "./data", "The directory of the 'dir' store")
+	eviction := flags.String("eviction", "reject", "What to do when the 'memory' store is full: 'reject', 'lru', 'lfu' or 'random'")
+	history := flags.Int("history", defaultHistory, "The number of previous values kept per key of the 'memory' store for reads at a revision")
+	nsDir := flags.String("ns-dir", "./namespaces", "The directory the namespaces are stored in, each in its own store")
+	tokensFile := flags.String("tokens", "", "A JSON file with the bearer tokens and their grants, reloaded on SIGHUP; without it no token is needed")
+	tlsCert := flags.String("tls-cert", "", "A PEM certificate to serve HTTPS with, reloaded on SIGHUP; needs -tls-key")
+	tlsKey := flags.String("tls-key", "", "The PEM private key of -tls-cert")
+	clientCA := flags.String("client-ca", "", "A PEM bundle of the CAs whose client certificates are accepted, without it clients need none")
+	limitOpts := registerLimitFlags(flags)
 	if err := flags.Parse(args[1:]); err != nil {
 		return fmt.Errorf("failed to parse flags: %w", err)
 	}
+	dbLimits, err := limitOpts.resolve(flags, os.LookupEnv)
+	if err != nil {
+		return fmt.Errorf("invalid limits: %w", err)
+	}
+	policy, err := parseSyncPolicy(*walSync)
+	if err != nil {
+		return err
+	}
+	evictPolicy, err := parseEvictionPolicy(*eviction)
+	if err != nil {
+		return err
+	}
 
-	s := newServer(log)
+	var store Store
+	var db *database
+	// openNamespace opens the store of a namespace in dir, it's of the same kind as the default store
+	var openNamespace func(dir string, l limits) (Store, error)
+	switch *storeKind {
+	case "memory":
+		db, err = openDatabase(*dbFile, dbLimits, *startEmpty, policy, log)
+		if err != nil {
+			return err
+		}
+		db.backups = *dbBackups
+		db.setEviction(evictPolicy)
+		db.setHistory(*history)
+		store = db
+		openNamespace = func(dir string, l limits) (Store, error) {
+			if err := os.MkdirAll(dir, dirPerm); err != nil {
+				return nil, fmt.Errorf("can't create namespace directory: %w", err)
+			}
+			nsDB, err := openDatabase(filepath.Join(dir, "database.snap"), l, false, policy, log)
+			if err != nil {
+				return nil, err
+			}
+			nsDB.backups = *dbBackups
+			nsDB.setEviction(evictPolicy)
+			nsDB.setHistory(*history)
+			return nsDB, nil
+		}
+	case "dir":
+		if evictPolicy != evictReject {
+			return fmt.Errorf("the 'dir' store only supports the 'reject' eviction policy")
+		}
+		store, err = newDirStore(*storeDir, dbLimits)
+		if err != nil {
+			return fmt.Errorf("failed to open store: %w", err)
+		}
+		log.Info("opened store", "dir", *storeDir)
+		openNamespace = func(dir string, l limits) (Store, error) {
+			return newDirStore(filepath.Join(dir, "data"), l)
+		}
+	default:
+		return fmt.Errorf("unknown store %q, use either 'memory' or 'dir'", *storeKind)
+	}
+	log.Info("using limits", "maxKeyLen", dbLimits.KeyLen, "maxValueLen", dbLimits.ValueLen, "maxEntries", dbLimits.Entries)
+	ns, err := loadNamespaces(*nsDir, dbLimits, openNamespace)
+	if err != nil {
+		return fmt.Errorf("failed to open namespaces: %w", err)
+	}
+	log.Info("opened namespaces", "dir", *nsDir, "count", len(ns.list()))
+	s := newServer(log, store, dbLimits, ns)
+	var certs *certReloader
+	if *tlsCert != "" || *tlsKey != "" || *clientCA != "" {
+		if certs, err = loadCertReloader(*tlsCert, *tlsKey, *clientCA); err != nil {
+			return fmt.Errorf("failed to load certificates: %w", err)
+		}
+		log.Info("loaded certificates", "cert", *tlsCert, "clientCA", *clientCA)
+	}
+	if *tokensFile != "" {
+		if s.auth, err = loadAuthenticator(*tokensFile); err != nil {
+			return fmt.Errorf("failed to load tokens: %w", err)
+		}
+		log.Info("loaded tokens", "file", *tokensFile)
+	} else {
+		log.Warn("no tokens file, requests are served without authentication")
+	}
 	srv := &http.Server{
 		Addr:              *addr,
 		ReadHeaderTimeout: serverTimeoutSeconds * time.Second,
 	}
-	srv.Handler = s.mux
+	srv.Handler = s
+	if certs != nil {
+		srv.TLSConfig = certs.tlsConfig()
+	}
 	s.routes()
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	errWg, errCtx := errgroup.WithContext(ctx)
+	// requests see the shutdown, so watches end instead of blocking it
+	srv.BaseContext = func(net.Listener) context.Context { return errCtx }
 
 	ticker := time.NewTicker(tickerSeconds * time.Second)
 	errWg.Go(func() error {
 		for {
 			select {
 			case <-ticker.C:
-				err := s.db.persist()
+				err := s.eachStore(func(st Store) error {
+					if p, ok := st.(persister); ok {
+						return p.persist()
+					}
+					return nil
+				})
 				if err != nil {
 					return err
 				}
 			case <-errCtx.Done():
 				log.Info("stopping database and persist to disk")
 				ticker.Stop()
-				err := s.db.persist()
+				err := errors.Join(s.db.close(), s.ns.close())
 				if err != nil {
 					return fmt.Errorf("could not persist db to disk: %w", err)
 				}
@@ -72,8 +175,85 @@ func run(args []string, log *slog.Logger) error { //nolint:cyclop,funlen
 	})
 
 	errWg.Go(func() error {
-		log.Info("Server running", "address", *addr)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		reapTicker := time.NewTicker(reapSeconds * time.Second)
+		defer reapTicker.Stop()
+		for {
+			select {
+			case <-reapTicker.C:
+				_ = s.eachStore(func(st Store) error {
+					if r, ok := st.(reaper); ok {
+						if n := r.reap(); n > 0 {
+							log.Info("evicted expired entries", "count", n)
+						}
+					}
+					return nil
+				})
+			case <-errCtx.Done():
+				return nil
+			}
+		}
+	})
+
+	if db != nil && policy > 0 {
+		errWg.Go(func() error {
+			walTicker := time.NewTicker(time.Duration(policy))
+			defer walTicker.Stop()
+			for {
+				select {
+				case <-walTicker.C:
+					err := s.eachStore(func(st Store) error {
+						if d, ok := st.(*database); ok && d.wal != nil {
+							return d.wal.sync()
+						}
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+				case <-errCtx.Done():
+					return nil
+				}
+			}
+		})
+	}
+
+	if s.auth != nil || certs != nil {
+		errWg.Go(func() error {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			defer signal.Stop(hup)
+			for {
+				select {
+				case <-hup:
+					if s.auth != nil {
+						if n, err := s.auth.reload(); err != nil {
+							log.Error("failed to reload tokens, keeping the previous ones", "error", err)
+						} else {
+							log.Info("reloaded tokens", "count", n)
+						}
+					}
+					if certs != nil {
+						if err := certs.reload(); err != nil {
+							log.Error("failed to reload certificates, keeping the previous ones", "error", err)
+						} else {
+							log.Info("reloaded certificates")
+						}
+					}
+				case <-errCtx.Done():
+					return nil
+				}
+			}
+		})
+	}
+
+	errWg.Go(func() error {
+		log.Info("Server running", "address", *addr, "tls", certs != nil)
+		serve := srv.ListenAndServe
+		if certs != nil {
+			// the certificates come from the TLS config, so they can be reloaded
+			serve = func() error { return srv.ListenAndServeTLS("", "") }
+		}
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return fmt.Errorf("the server failed with error: %w", err)
 		}
 		return nil
@@ -88,7 +268,7 @@ func run(args []string, log *slog.Logger) error { //nolint:cyclop,funlen
 		return nil
 	})
 
-	err := errWg.Wait()
+	err = errWg.Wait()
 	if !errors.Is(err, context.Canceled) && err != nil {
 		return fmt.Errorf("server error: %w", err)
 	}
@@ -96,17 +276,68 @@ func run(args []string, log *slog.Logger) error { //nolint:cyclop,funlen
 	return nil
 }
 
-func newServer(log *slog.Logger) *server {
-	db := make(map[string]string)
+// openDatabase restores the database from path and replays the write-ahead log on top of it.
+// If the snapshot or the log is unusable the server refuses to start, unless startEmpty is set.
+// In that case an unusable snapshot and its log are moved aside before the server starts with an empty database,
+// an unusable log is moved aside before the server starts with the snapshot alone.
+// Temp files left by a crash during a persist are removed.
+func openDatabase(path string, l limits, startEmpty bool, policy syncPolicy, log *slog.Logger) (*database, error) {
+	if err := removeTempFiles(path); err != nil {
+		return nil, err
+	}
+	db, err := loadDatabase(path, l)
+	var snapErr *SnapshotError
+	switch {
+	case errors.As(err, &snapErr) && startEmpty:
+		dst, err := quarantine(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := quarantine(walPath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		log.Warn("starting with an empty database", "error", snapErr, "moved to", dst)
+		db = newDatabase(path, l)
+	case err != nil:
+		return nil, fmt.Errorf("failed to restore database: %w", err)
+	}
+	w, records, discarded, err := openWAL(walPath(path), policy, db.replay)
+	var walErr *WALError
+	switch {
+	case errors.As(err, &walErr) && startEmpty:
+		dst, err := quarantine(walPath(path))
+		if err != nil {
+			return nil, err
+		}
+		log.Warn("starting without the write-ahead log", "error", walErr, "moved to", dst)
+		// the records before the corrupt one were already replayed
+		if db, err = loadDatabase(path, l); err != nil {
+			return nil, fmt.Errorf("failed to restore database: %w", err)
+		}
+		if w, records, discarded, err = openWAL(walPath(path), policy, db.replay); err != nil {
+			return nil, fmt.Errorf("failed to restore database: %w", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to restore database: %w", err)
+	}
+	if discarded > 0 {
+		log.Warn("discarded torn write-ahead log tail", "bytes", discarded)
+	}
+	db.wal = w
+	log.Info("restored database", "path", path, "entries", len(db.db), "replayed", records)
+	return db, nil
+}
+
+func newServer(log *slog.Logger, db Store, l limits, ns *namespaces) *server {
 	httpRequestsTotal := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "http_requests_total",
 		Help: "Count of all HTTP requests",
 	})
 	s := &server{
-		log: log,
-		db: &database{
-			db: db,
-		},
+		log:                  log,
+		db:                   db,
+		limits:               l,
+		ns:                   ns,
 		mux:                  http.NewServeMux(),
 		requestCounterMetric: httpRequestsTotal,
 	}
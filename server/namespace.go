@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// namespaceManifest is the file in the namespace directory that lists the namespaces and their quotas.
+const namespaceManifest = "namespaces.json"
+
+// namespaceName is the syntax of namespace names, they are used as directory names.
+var namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`) //nolint:gochecknoglobals
+
+// NoNamespaceError is returned for a request to a namespace that doesn't exist.
+type NoNamespaceError struct {
+	name string
+}
+
+func (e *NoNamespaceError) Error() string {
+	return fmt.Sprintf("error: namespace \"%s\" doesn't exist", e.name)
+}
+
+// NamespaceExistsError is returned for the creation of a namespace that already exists.
+type NamespaceExistsError struct {
+	name string
+}
+
+func (e *NamespaceExistsError) Error() string {
+	return fmt.Sprintf("error: namespace \"%s\" already exists", e.name)
+}
+
+// namespace is a keyspace with its own store, so it has its own quotas, revisions, watches and history.
+type namespace struct {
+	name  string
+	store Store
+	// quota is the quota the namespace was created with, limits is resolved from it and the limits of the server
+	quota  quota
+	limits limits
+	// requests counts the requests to the namespace for the metrics
+	requests atomic.Uint64
+
+	// mu is held for reading by every request to the namespace, so remove can wait for them before it closes the store
+	mu      sync.RWMutex
+	removed bool
+	// ctx is canceled by remove, it ends the watches and long polls of the namespace
+	ctx    context.Context //nolint:containedctx
+	cancel context.CancelFunc
+}
+
+func newNamespace(name string, st Store, q quota, l limits) *namespace {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &namespace{name: name, store: st, quota: q, limits: l, ctx: ctx, cancel: cancel}
+}
+
+// enter starts a request to the namespace, it fails once the namespace is removed.
+// Every successful enter must be followed by a leave.
+func (ns *namespace) enter() bool {
+	ns.mu.RLock()
+	if ns.removed {
+		ns.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (ns *namespace) leave() {
+	ns.mu.RUnlock()
+}
+
+// drain ends the requests to the namespace, waits until they are done and rejects new ones.
+func (ns *namespace) drain() {
+	ns.cancel()
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.removed = true
+}
+
+// namespaces holds the namespaces of the server.
+// Every namespace is stored in its own directory below dir, which also holds the manifest.
+type namespaces struct {
+	mu     sync.RWMutex
+	dir    string
+	byName map[string]*namespace
+	// removing holds the names of the namespaces whose directories are being removed, they can't be created again until then
+	removing map[string]bool
+	// limits are the limits of the server, the quotas of a namespace can't exceed them
+	limits limits
+	// open opens the store of a namespace in dir with the limits of the namespace
+	open func(dir string, l limits) (Store, error)
+}
+
+// quota is the JSON form of the quotas of a namespace, zero means the limit of the server.
+type quota struct {
+	Name       string `json:"name"`
+	MaxEntries int    `json:"maxEntries"`
+	MaxBytes   int    `json:"maxBytes"`
+}
+
+// newNamespaces returns an empty set of namespaces, dir is only used once a namespace is created.
+func newNamespaces(dir string, l limits, open func(dir string, l limits) (Store, error)) *namespaces {
+	return &namespaces{dir: dir, byName: make(map[string]*namespace), removing: make(map[string]bool), limits: l, open: open}
+}
+
+// loadNamespaces opens the namespaces of the manifest in dir.
+func loadNamespaces(dir string, l limits, open func(dir string, l limits) (Store, error)) (*namespaces, error) {
+	n := newNamespaces(dir, l, open)
+	if err := removeTempFiles(filepath.Join(dir, namespaceManifest)); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, namespaceManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return n, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read namespaces: %w", err)
+	}
+	var quotas []quota
+	if err := json.Unmarshal(b, &quotas); err != nil {
+		return nil, fmt.Errorf("can't read namespaces: %w", err)
+	}
+	for _, q := range quotas {
+		if err := checkNamespaceName(q.Name); err != nil {
+			return nil, err
+		}
+		// the server may have been restarted with lower limits than the quota
+		l := n.resolve(q)
+		st, err := open(filepath.Join(dir, q.Name), l)
+		if err != nil {
+			return nil, fmt.Errorf("can't open namespace %q: %w", q.Name, err)
+		}
+		n.byName[q.Name] = newNamespace(q.Name, st, q, l)
+	}
+	return n, nil
+}
+
+func checkNamespaceName(name string) error {
+	if !namespaceName.MatchString(name) {
+		return &RequestError{err: fmt.Errorf("error: namespace %q must match %s", name, namespaceName)} //nolint:goerr113
+	}
+	return nil
+}
+
+// limitsOf checks the quota q of a new namespace and returns its limits.
+func (n *namespaces) limitsOf(q quota) (limits, error) {
+	if err := checkNamespaceName(q.Name); err != nil {
+		return limits{}, err
+	}
+	l := n.limits
+	if q.MaxEntries < 0 || q.MaxEntries > l.Entries || q.MaxBytes < 0 || (l.Bytes > 0 && q.MaxBytes > l.Bytes) {
+		return limits{}, &RequestError{err: fmt.Errorf("error: the quotas of a namespace must be between 0 and the limits of the server")} //nolint:goerr113
+	}
+	return n.resolve(q), nil
+}
+
+// resolve returns the limits of a namespace with quota q, a quota is capped at the limit of the server.
+func (n *namespaces) resolve(q quota) limits {
+	l := n.limits
+	if q.MaxEntries > 0 && q.MaxEntries < l.Entries {
+		l.Entries = q.MaxEntries
+	}
+	if q.MaxBytes > 0 && (l.Bytes == 0 || q.MaxBytes < l.Bytes) {
+		l.Bytes = q.MaxBytes
+	}
+	return l
+}
+
+func (n *namespaces) get(name string) (*namespace, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	ns, ok := n.byName[name]
+	return ns, ok
+}
+
+// list returns the namespaces in ascending order of their names.
+func (n *namespaces) list() []*namespace {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	list := make([]*namespace, 0, len(n.byName))
+	for _, ns := range n.byName {
+		list = append(list, ns)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// create opens the store of a new namespace and adds it to the manifest.
+func (n *namespaces) create(q quota) (*namespace, error) {
+	l, err := n.limitsOf(q)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.byName[q.Name]; ok || n.removing[q.Name] {
+		return nil, &NamespaceExistsError{name: q.Name}
+	}
+	st, err := n.open(filepath.Join(n.dir, q.Name), l)
+	if err != nil {
+		return nil, fmt.Errorf("can't open namespace %q: %w", q.Name, err)
+	}
+	ns := newNamespace(q.Name, st, q, l)
+	n.byName[q.Name] = ns
+	if err := n.writeManifest(); err != nil {
+		delete(n.byName, q.Name)
+		return nil, errors.Join(err, st.close())
+	}
+	return ns, nil
+}
+
+// remove deletes a namespace with all its entries.
+// The requests to the namespace are ended and waited for before its store is closed.
+// Only taking the namespace out of the manifest holds n.mu, so a slow request to it doesn't block the other namespaces.
+func (n *namespaces) remove(name string) error {
+	ns, err := n.unlist(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.removing, name)
+	}()
+	ns.drain()
+	if err := ns.store.close(); err != nil {
+		return err
+	}
+	if n.dir == "" {
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(n.dir, name)); err != nil {
+		return fmt.Errorf("can't remove namespace %q: %w", name, err)
+	}
+	return nil
+}
+
+// unlist takes the namespace out of the manifest and marks it as being removed.
+func (n *namespaces) unlist(name string) (*namespace, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ns, ok := n.byName[name]
+	if !ok {
+		return nil, &NoNamespaceError{name: name}
+	}
+	delete(n.byName, name)
+	if err := n.writeManifest(); err != nil {
+		n.byName[name] = ns
+		return nil, err
+	}
+	n.removing[name] = true
+	return ns, nil
+}
+
+// writeManifest atomically replaces the manifest, the caller must hold n.mu.
+func (n *namespaces) writeManifest() error {
+	if n.dir == "" {
+		return nil
+	}
+	quotas := make([]quota, 0, len(n.byName))
+	for _, ns := range n.byName {
+		quotas = append(quotas, ns.quota)
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Name < quotas[j].Name })
+	if err := os.MkdirAll(n.dir, dirPerm); err != nil {
+		return fmt.Errorf("can't create namespace directory: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(n.dir, namespaceManifest), 0, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(quotas) //nolint:wrapcheck
+	})
+}
+
+// close closes the stores of all namespaces.
+func (n *namespaces) close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var errs []error
+	for _, ns := range n.byName {
+		errs = append(errs, ns.store.close())
+	}
+	return errors.Join(errs...)
+}
+
+//nolint:gochecknoglobals
+var (
+	namespaceEntriesDesc = prometheus.NewDesc("namespace_entries", "Count of entries in a namespace", []string{"namespace"}, nil)
+	namespaceBytesDesc   = prometheus.NewDesc("namespace_size_bytes", "Total size of all keys and values in a namespace", []string{"namespace"}, nil)
+	namespaceReqsDesc    = prometheus.NewDesc("namespace_requests_total", "Count of HTTP requests to a namespace", []string{"namespace"}, nil)
+)
+
+func (n *namespaces) Describe(ch chan<- *prometheus.Desc) {
+	ch <- namespaceEntriesDesc
+	ch <- namespaceBytesDesc
+	ch <- namespaceReqsDesc
+}
+
+// Collect reports the metrics of every namespace, labelled with its name.
+func (n *namespaces) Collect(ch chan<- prometheus.Metric) {
+	for _, ns := range n.list() {
+		ch <- prometheus.MustNewConstMetric(namespaceEntriesDesc, prometheus.GaugeValue, float64(len(ns.store.list())), ns.name)
+		ch <- prometheus.MustNewConstMetric(namespaceBytesDesc, prometheus.GaugeValue, float64(ns.store.bytes()), ns.name)
+		ch <- prometheus.MustNewConstMetric(namespaceReqsDesc, prometheus.CounterValue, float64(ns.requests.Load()), ns.name)
+	}
+}
+
+type namespaceKey struct{}
+
+// inNamespace serves the request with the store of the namespace in the path, unknown namespaces are not found.
+func (s *server) inNamespace(hf http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ns, ok := s.ns.get(r.PathValue("ns"))
+		if !ok || !ns.enter() {
+			s.writeError(w, r, &NoNamespaceError{name: r.PathValue("ns")})
+			return
+		}
+		defer ns.leave()
+		ns.requests.Add(1)
+		ctx, cancel := context.WithCancel(context.WithValue(r.Context(), namespaceKey{}, ns))
+		defer cancel()
+		stop := context.AfterFunc(ns.ctx, cancel)
+		defer stop()
+		hf(w, r.WithContext(ctx))
+	}
+}
+
+// store returns the store of the namespace of the request, the default store outside of namespaces.
+func (s *server) store(r *http.Request) Store {
+	if ns, ok := r.Context().Value(namespaceKey{}).(*namespace); ok {
+		return ns.store
+	}
+	return s.db
+}
+
+// limitsOf returns the limits of the namespace of the request.
+func (s *server) limitsOf(r *http.Request) limits {
+	if ns, ok := r.Context().Value(namespaceKey{}).(*namespace); ok {
+		return ns.limits
+	}
+	return s.limits
+}
+
+// eachStore calls f with the default store and the store of every namespace until f fails.
+// Namespaces are not removed meanwhile, so f never sees a closed store.
+func (s *server) eachStore(f func(Store) error) error {
+	if err := f(s.db); err != nil {
+		return err
+	}
+	s.ns.mu.RLock()
+	defer s.ns.mu.RUnlock()
+	for _, ns := range s.ns.byName {
+		if err := f(ns.store); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namespaceInfo describes a namespace with its quotas and usage.
+type namespaceInfo struct {
+	Name       string `json:"name"`
+	MaxEntries int    `json:"maxEntries"`
+	MaxBytes   int    `json:"maxBytes"`
+	Entries    int    `json:"entries"`
+	Bytes      int    `json:"bytes"`
+}
+
+func (ns *namespace) info() namespaceInfo {
+	return namespaceInfo{
+		Name: ns.name, MaxEntries: ns.limits.Entries, MaxBytes: ns.limits.Bytes,
+		Entries: len(ns.store.list()), Bytes: ns.store.bytes(),
+	}
+}
+
+type namespacesResponse struct {
+	Namespaces []namespaceInfo `json:"namespaces"`
+}
+
+// handleNamespaces lists the namespaces.
+func (s *server) handleNamespaces() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := namespacesResponse{Namespaces: []namespaceInfo{}}
+		for _, ns := range s.ns.list() {
+			resp.Namespaces = append(resp.Namespaces, ns.info())
+		}
+		s.writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// handleNamespace describes a namespace.
+func (s *server) handleNamespace() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ns, ok := s.ns.get(r.PathValue("ns"))
+		if !ok {
+			s.writeError(w, r, &NoNamespaceError{name: r.PathValue("ns")})
+			return
+		}
+		s.writeJSON(w, http.StatusOK, ns.info())
+	}
+}
+
+// handleCreateNamespace creates a namespace, the optional body sets its quotas.
+func (s *server) handleCreateNamespace() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var q quota
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil && !errors.Is(err, io.EOF) {
+			s.writeError(w, r, &RequestError{err: fmt.Errorf("error: body is not a quota: %w", err)})
+			return
+		}
+		q.Name = r.PathValue("ns")
+		ns, err := s.ns.create(q)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		s.log.Info("created namespace", "namespace", ns.name, "maxEntries", ns.limits.Entries, "maxBytes", ns.limits.Bytes)
+		s.writeJSON(w, http.StatusCreated, ns.info())
+	}
+}
+
+// handleDeleteNamespace deletes a namespace with all its entries.
+func (s *server) handleDeleteNamespace() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.ns.remove(r.PathValue("ns")); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		s.log.Info("deleted namespace", "namespace", r.PathValue("ns"))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *server) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", jsonMediaType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Info("Error writing response", "error", err)
+	}
+}
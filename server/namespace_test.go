@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestNamespaceRoutes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+		want   namespaceInfo
+	}{
+		{
+			name: "create", method: http.MethodPut, path: "/v1/ns/new", code: http.StatusCreated,
+			want: namespaceInfo{Name: "new", MaxEntries: defaultMaxEntries},
+		},
+		{
+			name: "create with quota", method: http.MethodPut, path: "/v1/ns/new", body: `{"maxEntries":5,"maxBytes":100}`,
+			code: http.StatusCreated, want: namespaceInfo{Name: "new", MaxEntries: 5, MaxBytes: 100},
+		},
+		{name: "create exists", method: http.MethodPut, path: "/v1/ns/team", code: http.StatusConflict},
+		{name: "create invalid name", method: http.MethodPut, path: "/v1/ns/Team", code: http.StatusBadRequest},
+		{name: "create name too long", method: http.MethodPut, path: "/v1/ns/" + strings.Repeat("a", 64), code: http.StatusBadRequest},
+		{name: "create invalid body", method: http.MethodPut, path: "/v1/ns/new", body: `{`, code: http.StatusBadRequest},
+		{name: "create negative quota", method: http.MethodPut, path: "/v1/ns/new", body: `{"maxEntries":-1}`, code: http.StatusBadRequest},
+		{
+			name: "create quota above limit", method: http.MethodPut, path: "/v1/ns/new", body: `{"maxEntries":1000000}`,
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "get", method: http.MethodGet, path: "/v1/ns/team", code: http.StatusOK,
+			want: namespaceInfo{Name: "team", MaxEntries: 2, Entries: 1, Bytes: 2},
+		},
+		{name: "get missing", method: http.MethodGet, path: "/v1/ns/missing", code: http.StatusNotFound},
+		{name: "delete", method: http.MethodDelete, path: "/v1/ns/team", code: http.StatusOK},
+		{name: "delete missing", method: http.MethodDelete, path: "/v1/ns/missing", code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{})
+			ns, err := s.ns.create(quota{Name: "team", MaxEntries: 2})
+			is.NoErr(err)
+			_, _, err = ns.store.put("a", "1", putOptions{})
+			is.NoErr(err)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			if tt.want.Name != "" {
+				var got namespaceInfo
+				is.NoErr(json.Unmarshal(w.Body.Bytes(), &got))
+				is.Equal(got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespaceList(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	s := testServer(map[string]string{})
+	for _, name := range []string{"b", "a"} {
+		_, err := s.ns.create(quota{Name: name})
+		is.NoErr(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/ns", nil)
+	w := httptest.NewRecorder()
+	s.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusOK)
+	var got namespacesResponse
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &got))
+	is.Equal(len(got.Namespaces), 2)
+	is.Equal(got.Namespaces[0].Name, "a") // namespaces are sorted by name
+	is.Equal(got.Namespaces[1].Name, "b")
+}
+
+func TestNamespaceKeys(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	s := testServer(map[string]string{"a": "default"})
+	_, err := s.ns.create(quota{Name: "team", MaxEntries: 1})
+	is.NoErr(err)
+	s.routes()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	is.Equal(do(http.MethodGet, "/v1/ns/team/keys/a", "").Code, http.StatusNotFound) // keys of the default store are not visible
+	is.Equal(do(http.MethodPut, "/v1/ns/team/keys/a", "team").Code, http.StatusCreated)
+	w := do(http.MethodGet, "/v1/ns/team/keys/a", "")
+	is.Equal(w.Body.String(), "team")
+	is.Equal(w.Header().Get("X-Mod-Revision"), "1") // every namespace has its own revisions
+	is.Equal(do(http.MethodGet, "/v1/keys/a", "").Body.String(), "default")
+
+	// the quota of the namespace is enforced while the default store has room
+	w = do(http.MethodPut, "/v1/ns/team/keys/b", "2")
+	is.Equal(w.Code, http.StatusInsufficientStorage)
+	is.Equal(do(http.MethodPut, "/v1/keys/b", "2").Code, http.StatusCreated)
+
+	var l limits
+	is.NoErr(json.Unmarshal(do(http.MethodGet, "/v1/ns/team/limits", "").Body.Bytes(), &l))
+	is.Equal(l.Entries, 1)
+
+	is.Equal(do(http.MethodGet, "/v1/ns/missing/keys/a", "").Code, http.StatusNotFound)
+
+	body := do(http.MethodGet, "/metrics", "").Body.String()
+	is.True(strings.Contains(body, `namespace_entries{namespace="team"} 1`))
+	is.True(strings.Contains(body, `namespace_size_bytes{namespace="team"} 5`))
+	is.True(strings.Contains(body, `namespace_requests_total{namespace="team"} 5`))
+
+	is.Equal(do(http.MethodDelete, "/v1/ns/team", "").Code, http.StatusOK)
+	is.Equal(do(http.MethodGet, "/v1/ns/team/keys/a", "").Code, http.StatusNotFound)
+}
+
+func TestLoadNamespaces(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir := t.TempDir()
+	open := func(dir string, l limits) (Store, error) {
+		return newDirStore(dir, l)
+	}
+	n, err := loadNamespaces(dir, defaultLimits(), open)
+	is.NoErr(err)
+	is.Equal(len(n.list()), 0) // a missing manifest has no namespaces
+
+	for _, q := range []quota{{Name: "a", MaxEntries: 3}, {Name: "b"}} {
+		_, err := n.create(q)
+		is.NoErr(err)
+	}
+	ns, _ := n.get("a")
+	_, _, err = ns.store.put("k", "v", putOptions{})
+	is.NoErr(err)
+	is.NoErr(n.remove("b"))
+	is.NoErr(n.close())
+
+	restored, err := loadNamespaces(dir, defaultLimits(), open)
+	is.NoErr(err)
+	defer restored.close()
+	is.Equal(len(restored.list()), 1)
+	ns, ok := restored.get("a")
+	is.True(ok)
+	is.Equal(ns.limits.Entries, 3)
+	e, ok, _ := ns.store.get("k")
+	is.True(ok)
+	is.Equal(e.value, "v")
+
+	var noNamespace *NoNamespaceError
+	is.True(errors.As(restored.remove("b"), &noNamespace))
+}
+
+func TestLoadNamespacesLowerLimits(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir := t.TempDir()
+	open := func(dir string, l limits) (Store, error) {
+		return newDirStore(dir, l)
+	}
+	n, err := loadNamespaces(dir, defaultLimits(), open)
+	is.NoErr(err)
+	for _, q := range []quota{{Name: "a", MaxEntries: 300}, {Name: "b"}} {
+		_, err := n.create(q)
+		is.NoErr(err)
+	}
+	is.NoErr(n.close())
+
+	// the quotas are capped at the lower limits of the server
+	lower := defaultLimits()
+	lower.Entries = 200
+	restored, err := loadNamespaces(dir, lower, open)
+	is.NoErr(err)
+	a, _ := restored.get("a")
+	is.Equal(a.limits.Entries, 200)
+	b, _ := restored.get("b")
+	is.Equal(b.limits.Entries, 200)
+	is.NoErr(restored.close())
+
+	// and back once the limits are raised again
+	restored, err = loadNamespaces(dir, defaultLimits(), open)
+	is.NoErr(err)
+	defer restored.close()
+	a, _ = restored.get("a")
+	is.Equal(a.limits.Entries, 300)
+	b, _ = restored.get("b")
+	is.Equal(b.limits.Entries, defaultMaxEntries)
+}
+
+func TestRemoveNamespaceInFlight(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	s := testServer(map[string]string{})
+	ns, err := s.ns.create(quota{Name: "team"})
+	is.NoErr(err)
+	_, err = s.ns.create(quota{Name: "other"})
+	is.NoErr(err)
+	s.routes()
+
+	// a long poll is ended by the removal
+	polled := make(chan int)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/v1/ns/team/changes?key=a&timeout=1m", nil)
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, req)
+		polled <- w.Code
+	}()
+	for ns.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the store isn't closed while a request uses it
+	is.True(ns.enter())
+	removed := make(chan error)
+	go func() {
+		removed <- s.ns.remove("team")
+	}()
+	is.Equal(<-polled, http.StatusOK)
+	select {
+	case err := <-removed:
+		t.Fatalf("removed while a request is in flight: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	// the other namespaces are served while the removal waits
+	req := httptest.NewRequest(http.MethodGet, "/v1/ns/other/keys/a", nil)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusNotFound)
+	var p problem
+	is.NoErr(json.NewDecoder(w.Body).Decode(&p))
+	is.Equal(p.Code, codeNotFound) // the key is missing, not the namespace
+	// the name is only free again once the directory is removed
+	_, err = s.ns.create(quota{Name: "team"})
+	var existsErr *NamespaceExistsError
+	is.True(errors.As(err, &existsErr))
+	_, _, err = ns.store.put("a", "1", putOptions{})
+	is.NoErr(err)
+	ns.leave()
+	is.NoErr(<-removed)
+
+	is.True(!ns.enter()) // requests that found the namespace before its removal are rejected
+	req = httptest.NewRequest(http.MethodGet, "/v1/ns/team/keys/a", nil)
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusNotFound)
+	_, err = s.ns.create(quota{Name: "team"})
+	is.NoErr(err)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// openAPISpec is the OpenAPI 3 document of the /v1 routes outside of namespaces,
+// the tests keep it in sync with apiRoutes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPIDocument is openAPISpec with the namespaced paths and the responses of authentication added,
+// it's built once on first use.
+var openAPIDocument = sync.OnceValues(func() ([]byte, error) { //nolint:gochecknoglobals
+	var doc map[string]any
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		return nil, fmt.Errorf("error: can't parse OpenAPI document: %w", err)
+	}
+	paths, _ := doc["paths"].(map[string]any)
+	if err := addNamespacedPaths(paths); err != nil {
+		return nil, err
+	}
+	addAuthResponses(paths)
+	return json.MarshalIndent(doc, "", "  ")
+})
+
+// problemResponse references the response of a problem document.
+func problemResponse() map[string]any {
+	return map[string]any{"$ref": "#/components/responses/Problem"}
+}
+
+// addNamespacedPaths copies the path items of namespacedPaths to their path in a namespace,
+// with the ns parameter first, the operation ids suffixed with "InNamespace"
+// and a 404 response for a missing namespace.
+func addNamespacedPaths(paths map[string]any) error {
+	for path := range namespacedPaths {
+		path = strings.ReplaceAll(path, "...}", "}")
+		item, ok := paths[path].(map[string]any)
+		if !ok {
+			return fmt.Errorf("error: OpenAPI document has no path %s", path) //nolint:goerr113
+		}
+		copied := map[string]any{}
+		for key, value := range item {
+			if op, ok := value.(map[string]any); ok && key != "parameters" {
+				op = maps.Clone(op)
+				op["operationId"] = fmt.Sprint(op["operationId"]) + "InNamespace"
+				responses, _ := op["responses"].(map[string]any)
+				responses = maps.Clone(responses)
+				if _, ok := responses["404"]; !ok {
+					responses["404"] = problemResponse()
+				}
+				op["responses"] = responses
+				value = op
+			}
+			copied[key] = value
+		}
+		params, _ := item["parameters"].([]any)
+		ns := map[string]any{"$ref": "#/components/parameters/Namespace"}
+		copied["parameters"] = append([]any{ns}, params...)
+		paths[namespacePath(path)] = copied
+	}
+	return nil
+}
+
+// addAuthResponses adds the 401 and 403 responses to the operations that need a token,
+// the public ones have an empty security requirement.
+func addAuthResponses(paths map[string]any) {
+	for _, item := range paths {
+		for key, value := range item.(map[string]any) { //nolint:forcetypeassert
+			op, ok := value.(map[string]any)
+			if !ok || key == "parameters" {
+				continue
+			}
+			if security, ok := op["security"].([]any); ok && len(security) == 0 {
+				continue
+			}
+			responses, _ := op["responses"].(map[string]any)
+			responses["401"] = problemResponse()
+			responses["403"] = problemResponse()
+		}
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document, so clients can be generated from it.
+func (s *server) handleOpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, err := openAPIDocument()
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", jsonMediaType)
+		if _, err := w.Write(doc); err != nil {
+			s.log.Info("Error writing response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// openAPIDoc is the part of the OpenAPI document the tests check.
+type openAPIDoc struct {
+	OpenAPI string                                `json:"openapi"`
+	Paths   map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+type openAPIOperation struct {
+	Responses map[string]json.RawMessage `json:"responses"`
+}
+
+func parseOpenAPI(t *testing.T) openAPIDoc {
+	t.Helper()
+	is := is.New(t)
+	spec, err := openAPIDocument()
+	is.NoErr(err)
+	var doc openAPIDoc
+	is.NoErr(json.Unmarshal(spec, &doc))
+	return doc
+}
+
+// specOperation turns a route pattern like "GET /v1/keys/{key...}" into the method and path of the document.
+func specOperation(pattern string) (string, string) {
+	method, path, _ := strings.Cut(pattern, " ")
+	return strings.ToLower(method), strings.ReplaceAll(path, "...}", "}")
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	doc := parseOpenAPI(t)
+	is.True(strings.HasPrefix(doc.OpenAPI, "3."))
+
+	var routes []string
+	for _, rt := range testServer(map[string]string{}).apiRoutes() {
+		method, path := specOperation(rt.pattern)
+		routes = append(routes, method+" "+path)
+	}
+	var documented []string
+	for path, item := range doc.Paths {
+		for method := range item {
+			if method != "parameters" {
+				documented = append(documented, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+	is.Equal(routes, documented) // every route is documented and every operation is served
+}
+
+func TestOpenAPIResponses(t *testing.T) {
+	t.Parallel()
+	doc := parseOpenAPI(t)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+		// tokens makes the server require a token
+		tokens bool
+		code   int
+	}{
+		{name: "get", method: http.MethodGet, path: "/v1/keys/a", code: http.StatusOK},
+		{name: "get at a revision", method: http.MethodGet, path: "/v1/keys/a?rev=9", code: http.StatusBadRequest},
+		{name: "get missing", method: http.MethodGet, path: "/v1/keys/missing", code: http.StatusNotFound},
+		{name: "head", method: http.MethodHead, path: "/v1/keys/a", code: http.StatusOK},
+		{name: "head missing", method: http.MethodHead, path: "/v1/keys/missing", code: http.StatusNotFound},
+		{name: "create", method: http.MethodPut, path: "/v1/keys/b", body: "2", code: http.StatusCreated},
+		{name: "replace", method: http.MethodPut, path: "/v1/keys/a", body: "2", code: http.StatusOK},
+		{name: "put too long", method: http.MethodPut, path: "/v1/keys/a", body: strings.Repeat("v", 201), code: http.StatusRequestEntityTooLarge},
+		{
+			name: "put precondition", method: http.MethodPut, path: "/v1/keys/a", body: "2",
+			header: map[string]string{"If-Match": `"9"`}, code: http.StatusPreconditionFailed,
+		},
+		{name: "append", method: http.MethodPatch, path: "/v1/keys/a?op=append", body: "2", code: http.StatusOK},
+		{name: "incr", method: http.MethodPatch, path: "/v1/keys/n?op=incr", code: http.StatusCreated},
+		{name: "incr text", method: http.MethodPatch, path: "/v1/keys/a?op=incr&by=x", code: http.StatusBadRequest},
+		{name: "delete", method: http.MethodDelete, path: "/v1/keys/a", code: http.StatusOK},
+		{name: "delete missing", method: http.MethodDelete, path: "/v1/keys/missing", code: http.StatusNotFound},
+		{name: "list", method: http.MethodGet, path: "/v1/keys?prefix=a", code: http.StatusOK},
+		{name: "list limit", method: http.MethodGet, path: "/v1/keys?limit=x", code: http.StatusBadRequest},
+		{name: "batch", method: http.MethodPost, path: "/v1/batch", body: `[{"op":"get","key":"a"}]`, code: http.StatusOK},
+		{name: "batch body", method: http.MethodPost, path: "/v1/batch", body: `{`, code: http.StatusBadRequest},
+		{name: "txn", method: http.MethodPost, path: "/v1/txn", body: `{"ops":[{"op":"put","key":"c","value":"3"}]}`, code: http.StatusOK},
+		{
+			name: "txn check", method: http.MethodPost, path: "/v1/txn",
+			body: `{"checks":[{"key":"a","value":"2"}],"ops":[{"op":"delete","key":"a"}]}`, code: http.StatusPreconditionFailed,
+		},
+		{name: "watch", method: http.MethodGet, path: "/v1/watch?key=a", code: http.StatusOK},
+		{name: "watch rev", method: http.MethodGet, path: "/v1/watch?rev=x", code: http.StatusBadRequest},
+		{name: "changes", method: http.MethodGet, path: "/v1/changes?key=a&timeout=1ms", code: http.StatusOK},
+		{name: "changes timeout", method: http.MethodGet, path: "/v1/changes?timeout=x", code: http.StatusBadRequest},
+		{name: "history", method: http.MethodGet, path: "/v1/history?key=a", code: http.StatusOK},
+		{name: "history missing", method: http.MethodGet, path: "/v1/history?key=missing", code: http.StatusNotFound},
+		{name: "limits", method: http.MethodGet, path: "/v1/limits", code: http.StatusOK},
+		{name: "namespaces", method: http.MethodGet, path: "/v1/ns", code: http.StatusOK},
+		{name: "namespace", method: http.MethodGet, path: "/v1/ns/team", code: http.StatusOK},
+		{name: "namespace missing", method: http.MethodGet, path: "/v1/ns/missing", code: http.StatusNotFound},
+		{name: "create namespace", method: http.MethodPut, path: "/v1/ns/other", body: `{"maxEntries":10}`, code: http.StatusCreated},
+		{name: "create namespace invalid", method: http.MethodPut, path: "/v1/ns/Other", code: http.StatusBadRequest},
+		{name: "create namespace exists", method: http.MethodPut, path: "/v1/ns/team", code: http.StatusConflict},
+		{name: "delete namespace", method: http.MethodDelete, path: "/v1/ns/team", code: http.StatusOK},
+		{name: "delete namespace missing", method: http.MethodDelete, path: "/v1/ns/missing", code: http.StatusNotFound},
+		{name: "put in namespace", method: http.MethodPut, path: "/v1/ns/team/keys/a", body: "1", code: http.StatusCreated},
+		{name: "get in namespace", method: http.MethodGet, path: "/v1/ns/team/keys/a", code: http.StatusNotFound},
+		{name: "get in missing namespace", method: http.MethodGet, path: "/v1/ns/missing/keys/a", code: http.StatusNotFound},
+		{name: "list in missing namespace", method: http.MethodGet, path: "/v1/ns/missing/keys", code: http.StatusNotFound},
+		{name: "list in namespace", method: http.MethodGet, path: "/v1/ns/team/keys", code: http.StatusOK},
+		{name: "limits in namespace", method: http.MethodGet, path: "/v1/ns/team/limits", code: http.StatusOK},
+		{name: "unauthorized", method: http.MethodGet, path: "/v1/keys/a", tokens: true, code: http.StatusUnauthorized},
+		{
+			name: "forbidden", method: http.MethodGet, path: "/v1/ns/team/keys/a", tokens: true,
+			header: map[string]string{"Authorization": "Bearer reader-token"}, code: http.StatusForbidden,
+		},
+		{name: "openapi without token", method: http.MethodGet, path: "/v1/openapi.json", tokens: true, code: http.StatusOK},
+		{name: "openapi", method: http.MethodGet, path: "/v1/openapi.json", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{"a": "1"})
+			_, err := s.ns.create(quota{Name: "team"})
+			is.NoErr(err)
+			if tt.tokens {
+				s.auth = testAuthenticator(t, testTokens)
+			}
+			s.routes()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)).WithContext(ctx)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			// streams end once the client is gone
+			cancel()
+			_, pattern := s.mux.Handler(req)
+			is.True(pattern != "") // the request matches a route
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+
+			method, path := specOperation(pattern)
+			var op openAPIOperation
+			is.NoErr(json.Unmarshal(doc.Paths[path][method], &op))
+			_, ok := op.Responses[strconv.Itoa(w.Code)]
+			is.True(ok) // the status is documented
+		})
+	}
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		path      string
+		successor string
+	}{
+		{path: "/keys", successor: "/v1/keys"},
+		{path: "/limits", successor: "/v1/limits"},
+		{path: "/history?key=a", successor: "/v1/history"},
+		{path: "/db?key=a", successor: "/v1/keys/a"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{"a": "1"})
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, http.StatusOK)
+			is.Equal(w.Header().Get("Deprecation"), "true")
+			is.Equal(w.Header().Get("Link"), "<"+tt.successor+">; rel=\"successor-version\"")
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// The atomic operations of a PATCH, selected with the op query parameter.
+const (
+	patchAppend = "append"
+	patchIncr   = "incr"
+	patchDecr   = "decr"
+	patchGetSet = "getset"
+)
+
+var errPatchOp = errors.New("error: unknown patch operation, use either 'append', 'incr', 'decr' or 'getset'")
+
+// patch is an atomic read-modify-write of a value, so clients don't race between a GET and a PUT.
+type patch struct {
+	op string
+	// arg is the suffix of an append and the new value of a getset
+	arg string
+	// delta is added by an incr, it's negative for a decr
+	delta int64
+}
+
+// patchResult is the outcome of a patch. value is the new value, or the previous one for a getset.
+type patchResult struct {
+	code    int
+	version uint64
+	value   string
+	content content
+}
+
+// NumberError is returned for an increment of a value that isn't an integer or that would overflow.
+type NumberError struct {
+	key      string
+	overflow bool
+}
+
+func (e *NumberError) Error() string {
+	if e.overflow {
+		return fmt.Sprintf("error: increment of key \"%s\" overflows", e.key)
+	}
+	return fmt.Sprintf("error: value of key \"%s\" is not an integer", e.key)
+}
+
+// patch applies p to the value of key while holding the lock, a missing key is created:
+// an append to it stores the suffix and an increment starts at 0.
+// The entry keeps its content and expiry unless opts sets them.
+func (db *database) patch(key string, p patch, opts putOptions) (patchResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	current, ok := db.lookup(key)
+	res := patchResult{content: current.content}
+	var value string
+	switch p.op {
+	case patchAppend:
+		value = current.value + p.arg
+	case patchIncr, patchDecr:
+		n := int64(0)
+		if ok {
+			var err error
+			if n, err = strconv.ParseInt(current.value, 10, 64); err != nil {
+				return res, &NumberError{key: key}
+			}
+		}
+		if (p.delta > 0 && n > math.MaxInt64-p.delta) || (p.delta < 0 && n < math.MinInt64-p.delta) {
+			return res, &NumberError{key: key, overflow: true}
+		}
+		value = strconv.FormatInt(n+p.delta, 10)
+	case patchGetSet:
+		value = p.arg
+	default:
+		return res, errPatchOp
+	}
+	if opts.content == (content{}) {
+		opts.content = current.content
+	}
+	opts.keepExpiry = true
+	code, version, err := db.putLocked(key, value, opts)
+	if err != nil {
+		return res, err
+	}
+	res.code, res.version = code, version
+	if p.op != patchGetSet {
+		res.value, res.content = value, opts.content
+	} else {
+		res.value = current.value
+	}
+	return res, nil
+}
+
+// parsePatch reads the operation of a PATCH from the op query parameter and its argument:
+// the body for append and getset, the by query parameter for incr and decr, which defaults to 1.
+func parsePatch(r *http.Request) (patch, error) {
+	p := patch{op: r.URL.Query().Get("op")}
+	switch p.op {
+	case patchAppend, patchGetSet:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return p, fmt.Errorf("error: can't read body: %w", err)
+		}
+		p.arg = string(body)
+	case patchIncr, patchDecr:
+		p.delta = 1
+		if v := r.URL.Query().Get("by"); v != "" {
+			by, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || by == math.MinInt64 {
+				return p, fmt.Errorf("error: by %q is not an integer", v) //nolint:goerr113
+			}
+			p.delta = by
+		}
+		if p.op == patchDecr {
+			p.delta = -p.delta
+		}
+	default:
+		return p, errPatchOp
+	}
+	return p, nil
+}
+
+// handlePatch applies an atomic operation to the value of key and writes the resulting value,
+// the previous value for a getset. A created key is answered with 201 Created.
+// Writes with a Content-Type replace the stored one, as with a PUT.
+func (s *server) handlePatch(w http.ResponseWriter, r *http.Request, key string) {
+	pt, ok := s.store(r).(patcher)
+	if !ok {
+		s.writeError(w, r, &UnsupportedError{feature: "atomic operations"})
+		return
+	}
+	p, err := parsePatch(r)
+	if err != nil {
+		s.writeError(w, r, &RequestError{err: err})
+		return
+	}
+	ttl, err := parseTTL(r)
+	if err != nil {
+		s.writeError(w, r, &RequestError{err: err})
+		return
+	}
+	opts := putOptions{ttl: ttl, cond: parsePrecondition(r)}
+	// an increment stores a number whatever the type of the request
+	if p.op == patchAppend || p.op == patchGetSet {
+		if opts.content, err = parseContent(r); err != nil {
+			s.writeError(w, r, &RequestError{err: err})
+			return
+		}
+	}
+	res, err := pt.patch(key, p, opts)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	setContentHeaders(w, res.content)
+	w.Header().Set("ETag", formatETag(res.version))
+	w.Header().Set("X-Mod-Revision", strconv.FormatUint(res.version, 10))
+	w.WriteHeader(res.code)
+	if _, err := w.Write([]byte(res.value)); err != nil {
+		s.log.Info("Error writing response", "error", err)
+	}
+}
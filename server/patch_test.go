@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestPatch(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		key   string
+		patch patch
+		opts  putOptions
+		code  int
+		want  string
+		value string
+		err   error
+	}{
+		{name: "append", key: "log", patch: patch{op: patchAppend, arg: "c"}, code: http.StatusOK, want: "abc", value: "abc"},
+		{name: "append new", key: "new", patch: patch{op: patchAppend, arg: "c"}, code: http.StatusCreated, want: "c", value: "c"},
+		{name: "incr", key: "n", patch: patch{op: patchIncr, delta: 5}, code: http.StatusOK, want: "15", value: "15"},
+		{name: "decr", key: "n", patch: patch{op: patchDecr, delta: -11}, code: http.StatusOK, want: "-1", value: "-1"},
+		{name: "incr new", key: "new", patch: patch{op: patchIncr, delta: 1}, code: http.StatusCreated, want: "1", value: "1"},
+		{name: "getset", key: "log", patch: patch{op: patchGetSet, arg: "x"}, code: http.StatusOK, want: "ab", value: "x"},
+		{name: "getset new", key: "new", patch: patch{op: patchGetSet, arg: "x"}, code: http.StatusCreated, want: "", value: "x"},
+		{name: "incr text", key: "log", patch: patch{op: patchIncr, delta: 1}, err: &NumberError{}},
+		{name: "overflow", key: "max", patch: patch{op: patchIncr, delta: 1}, err: &NumberError{}},
+		{name: "append too long", key: "log", patch: patch{op: patchAppend, arg: strings.Repeat("v", 199)}, err: &ValueError{}},
+		{
+			name: "precondition", key: "n", patch: patch{op: patchIncr, delta: 1},
+			opts: putOptions{cond: precondition{ifMatch: etagList{present: true, versions: []uint64{9}}}}, err: &PreconditionError{},
+		},
+		{name: "unknown", key: "n", patch: patch{op: "mul"}, err: errPatchOp},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			db := newDatabase("", defaultLimits())
+			for key, value := range map[string]string{"log": "ab", "n": "10", "max": strconv.FormatInt(math.MaxInt64, 10)} {
+				_, _, err := db.put(key, value, putOptions{})
+				is.NoErr(err)
+			}
+
+			res, err := db.patch(tt.key, tt.patch, tt.opts)
+			switch want := tt.err.(type) {
+			case nil:
+				is.NoErr(err)
+				is.Equal(res.code, tt.code)
+				is.Equal(res.value, tt.want)
+				e, ok, _ := db.get(tt.key)
+				is.True(ok)
+				is.Equal(e.value, tt.value)
+				is.Equal(e.version, res.version)
+			case *NumberError:
+				is.True(errors.As(err, &want))
+			case *ValueError:
+				is.True(errors.As(err, &want))
+			case *PreconditionError:
+				is.True(errors.As(err, &want))
+			default:
+				is.True(errors.Is(err, want))
+			}
+		})
+	}
+}
+
+func TestPatchKeepsEntry(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	db := newDatabase("", defaultLimits())
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	db.now = clock.now
+	_, _, err := db.put("n", "1", putOptions{ttl: time.Minute, content: content{typ: "text/plain"}})
+	is.NoErr(err)
+
+	res, err := db.patch("n", patch{op: patchIncr, delta: 1}, putOptions{})
+	is.NoErr(err)
+	is.Equal(res.content, content{typ: "text/plain"})
+	e, _, _ := db.get("n")
+	// the expiry and the content type are kept
+	is.Equal(e.expires, time.Unix(1060, 0))
+	is.Equal(e.content, content{typ: "text/plain"})
+
+	_, err = db.patch("n", patch{op: patchIncr, delta: 1}, putOptions{ttl: time.Hour})
+	is.NoErr(err)
+	e, _, _ = db.get("n")
+	is.Equal(e.expires, time.Unix(4600, 0))
+	is.Equal(e.value, "3")
+}
+
+func TestPatchRequest(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		header map[string]string
+		code   int
+		want   string
+		ctype  string
+	}{
+		{name: "append", path: "/v1/keys/log?op=append", body: "c", code: http.StatusOK, want: "abc", ctype: defaultContentType},
+		{name: "incr", path: "/v1/keys/n?op=incr", code: http.StatusOK, want: "11", ctype: defaultContentType},
+		{name: "incr by", path: "/v1/keys/n?op=incr&by=-20", code: http.StatusOK, want: "-10", ctype: defaultContentType},
+		{name: "decr by", path: "/v1/keys/n?op=decr&by=3", code: http.StatusOK, want: "7", ctype: defaultContentType},
+		{
+			name: "getset", path: "/v1/keys/log?op=getset", body: "{}", header: map[string]string{"Content-Type": "application/json"},
+			code: http.StatusOK, want: "ab", ctype: defaultContentType,
+		},
+		{
+			name: "append type", path: "/v1/keys/new?op=append", body: "a", header: map[string]string{"Content-Type": "text/plain"},
+			code: http.StatusCreated, want: "a", ctype: "text/plain",
+		},
+		{name: "not a number", path: "/v1/keys/log?op=incr", code: http.StatusConflict, ctype: problemMediaType},
+		{name: "invalid by", path: "/v1/keys/n?op=incr&by=1.5", code: http.StatusBadRequest, ctype: problemMediaType},
+		{name: "unknown op", path: "/v1/keys/n?op=mul", code: http.StatusBadRequest, ctype: problemMediaType},
+		{name: "missing op", path: "/v1/keys/n", code: http.StatusBadRequest, ctype: problemMediaType},
+		{
+			name: "precondition", path: "/v1/keys/n?op=incr", header: map[string]string{"If-Match": `"1"`},
+			code: http.StatusPreconditionFailed, ctype: problemMediaType,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{"log": "ab", "n": "10"})
+
+			req := httptest.NewRequest(http.MethodPatch, tt.path, strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			is.Equal(w.Header().Get("Content-Type"), tt.ctype)
+			if tt.want != "" {
+				is.Equal(w.Body.String(), tt.want)
+				is.True(w.Header().Get("ETag") != "")
+			}
+		})
+	}
+}
+
+func TestPatchUnsupported(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	s := testServer(map[string]string{})
+	d, err := newDirStore(t.TempDir(), defaultLimits())
+	is.NoErr(err)
+	s.db = d
+
+	req := httptest.NewRequest(http.MethodPatch, "/v1/keys/n?op=incr", nil)
+	w := httptest.NewRecorder()
+	s.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusNotImplemented)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const problemMediaType = "application/problem+json"
+
+// The error codes of problem documents, clients can rely on them not to change.
+const (
+	codeNotFound           = "not_found"
+	codeNoNamespace        = "namespace_not_found"
+	codeNamespaceExists    = "namespace_exists"
+	codePreconditionFailed = "precondition_failed"
+	codeKeyTooLong         = "key_too_long"
+	codeValueTooLong       = "value_too_long"
+	codeDatabaseFull       = "database_full"
+	codeQuotaExceeded      = "quota_exceeded"
+	codeCompacted          = "revision_compacted"
+	codeFutureRevision     = "future_revision"
+	codeNotAnInteger       = "not_an_integer"
+	codeIntegerOverflow    = "integer_overflow"
+	codeUnknownOp          = "unknown_operation"
+	codeTxnOp              = "invalid_transaction_operation"
+	codeTooManyOps         = "too_many_operations"
+	codeBodyTooLarge       = "body_too_large"
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codeInvalidRequest     = "invalid_request"
+	codeNotImplemented     = "not_implemented"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeInternal           = "internal_error"
+)
+
+// problem is an RFC 7807 problem document, every error response of the server is one.
+// The type is always about:blank, Code tells the errors of a status apart.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	// Limit is the limit that was exceeded, e.g. the maximum key length for key_too_long
+	Limit *int `json:"limit,omitempty"`
+	// Key is the key the error is about, if any
+	Key string `json:"key,omitempty"`
+}
+
+// RequestError is returned for a request with invalid parameters or an invalid body.
+type RequestError struct {
+	err error
+}
+
+func (e *RequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.err
+}
+
+// UnsupportedError is returned for a request the store doesn't support, e.g. a watch of the dir store.
+type UnsupportedError struct {
+	feature string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("error: the store doesn't support %s", e.feature)
+}
+
+// TooManyOpsError is returned for a batch or transaction with more than maxOps operations.
+type TooManyOpsError struct {
+	maxOps int
+}
+
+func (e *TooManyOpsError) Error() string {
+	return fmt.Sprintf("error: the request exceeds %d operations", e.maxOps)
+}
+
+// problemOf describes err as a problem document, unknown errors are internal errors.
+func problemOf(err error) problem {
+	var keyErr *KeyError
+	var valueErr *ValueError
+	var dbErr *DatabaseError
+	var quotaErr *QuotaError
+	var noEntryErr *NoEntryError
+	var preconditionErr *PreconditionError
+	var compactedErr *CompactedError
+	var futureErr *FutureRevisionError
+	var requestErr *RequestError
+	var unsupportedErr *UnsupportedError
+	var tooManyOpsErr *TooManyOpsError
+	var numberErr *NumberError
+	var noNamespaceErr *NoNamespaceError
+	var namespaceExistsErr *NamespaceExistsError
+	var unauthorizedErr *UnauthorizedError
+	var forbiddenErr *ForbiddenError
+	var maxBytesErr *http.MaxBytesError
+	limit := func(n int) *int { return &n }
+
+	p := problem{Type: "about:blank", Status: http.StatusInternalServerError, Code: codeInternal, Detail: err.Error()}
+	switch {
+	case errors.As(err, &unauthorizedErr):
+		p.Status, p.Code = http.StatusUnauthorized, codeUnauthorized
+	case errors.As(err, &forbiddenErr):
+		p.Status, p.Code, p.Key = http.StatusForbidden, codeForbidden, forbiddenErr.key
+	case errors.As(err, &noEntryErr):
+		p.Status, p.Code, p.Key = http.StatusNotFound, codeNotFound, noEntryErr.key
+	case errors.As(err, &noNamespaceErr):
+		p.Status, p.Code = http.StatusNotFound, codeNoNamespace
+	case errors.As(err, &namespaceExistsErr):
+		p.Status, p.Code = http.StatusConflict, codeNamespaceExists
+	case errors.As(err, &preconditionErr):
+		p.Status, p.Code, p.Key = http.StatusPreconditionFailed, codePreconditionFailed, preconditionErr.key
+	case errors.As(err, &keyErr):
+		p.Status, p.Code, p.Limit = http.StatusRequestEntityTooLarge, codeKeyTooLong, limit(keyErr.maxLen)
+	case errors.As(err, &valueErr):
+		p.Status, p.Code, p.Limit = http.StatusRequestEntityTooLarge, codeValueTooLong, limit(valueErr.maxLen)
+	case errors.As(err, &dbErr):
+		p.Status, p.Code, p.Limit = http.StatusInsufficientStorage, codeDatabaseFull, limit(dbErr.maxLen)
+	case errors.As(err, &quotaErr):
+		p.Status, p.Code, p.Limit = http.StatusInsufficientStorage, codeQuotaExceeded, limit(quotaErr.maxBytes)
+	case errors.As(err, &compactedErr):
+		p.Status, p.Code = http.StatusGone, codeCompacted
+	case errors.As(err, &futureErr):
+		p.Status, p.Code = http.StatusBadRequest, codeFutureRevision
+	case errors.As(err, &numberErr):
+		p.Status, p.Code, p.Key = http.StatusConflict, codeNotAnInteger, numberErr.key
+		if numberErr.overflow {
+			p.Code = codeIntegerOverflow
+		}
+	case errors.Is(err, errUnknownOp), errors.Is(err, errPatchOp):
+		p.Status, p.Code = http.StatusBadRequest, codeUnknownOp
+	case errors.Is(err, errTxnOp):
+		p.Status, p.Code = http.StatusBadRequest, codeTxnOp
+	case errors.As(err, &tooManyOpsErr):
+		p.Status, p.Code, p.Limit = http.StatusRequestEntityTooLarge, codeTooManyOps, limit(tooManyOpsErr.maxOps)
+	case errors.As(err, &maxBytesErr):
+		p.Status, p.Code, p.Limit = http.StatusRequestEntityTooLarge, codeBodyTooLarge, limit(int(maxBytesErr.Limit))
+	case errors.As(err, &requestErr):
+		p.Status, p.Code = http.StatusBadRequest, codeInvalidRequest
+	case errors.As(err, &unsupportedErr):
+		p.Status, p.Code = http.StatusNotImplemented, codeNotImplemented
+	}
+	p.Title = http.StatusText(p.Status)
+	return p
+}
+
+// errorStatus maps the errors of the store to HTTP status codes.
+func errorStatus(err error) int {
+	return problemOf(err).Status
+}
+
+// writeError writes err as a problem document about the request.
+func (s *server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	p := problemOf(err)
+	if p.Status == http.StatusInternalServerError {
+		s.log.Error("request failed", "path", r.URL.Path, "error", err)
+	}
+	p.Instance = r.URL.Path
+	s.writeProblem(w, p)
+}
+
+func (s *server) writeProblem(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", problemMediaType)
+	w.Header().Del("Content-Encoding")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		s.log.Info("Error writing response", "error", err)
+	}
+}
+
+// ServeHTTP routes the request and turns the plain text 404 and 405 responses of the mux into problem documents.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, pattern := s.mux.Handler(r)
+	if pattern != "" {
+		// the mux sets the path values, Handler doesn't
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+	// no route matched, h redirects or answers with an error and sets the Location or Allow header
+	rec := &statusRecorder{header: w.Header()}
+	h.ServeHTTP(rec, r)
+	if rec.status < http.StatusBadRequest {
+		w.WriteHeader(rec.status)
+		return
+	}
+	p := problem{Type: "about:blank", Title: http.StatusText(rec.status), Status: rec.status, Instance: r.URL.Path}
+	switch rec.status {
+	case http.StatusNotFound:
+		p.Code, p.Detail = codeNotFound, fmt.Sprintf("error: there is no route %s", r.URL.Path)
+	case http.StatusMethodNotAllowed:
+		p.Code, p.Detail = codeMethodNotAllowed, fmt.Sprintf("error: %s only supports %s", r.URL.Path, w.Header().Get("Allow"))
+	default:
+		p.Code = codeInvalidRequest
+	}
+	s.writeProblem(w, p)
+}
+
+// statusRecorder keeps the status and the headers of a response but drops its body.
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *statusRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestProblemOf(t *testing.T) {
+	t.Parallel()
+	limit := func(n int) *int { return &n }
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		limit  *int
+	}{
+		{name: "not found", err: &NoEntryError{key: "a"}, status: http.StatusNotFound, code: codeNotFound},
+		{name: "precondition", err: &PreconditionError{key: "a"}, status: http.StatusPreconditionFailed, code: codePreconditionFailed},
+		{name: "key", err: &KeyError{maxLen: 20}, status: http.StatusRequestEntityTooLarge, code: codeKeyTooLong, limit: limit(20)},
+		{name: "value", err: &ValueError{maxLen: 200}, status: http.StatusRequestEntityTooLarge, code: codeValueTooLong, limit: limit(200)},
+		{name: "full", err: &DatabaseError{maxLen: 2}, status: http.StatusInsufficientStorage, code: codeDatabaseFull, limit: limit(2)},
+		{name: "quota", err: &QuotaError{maxBytes: 10}, status: http.StatusInsufficientStorage, code: codeQuotaExceeded, limit: limit(10)},
+		{name: "compacted", err: &CompactedError{rev: 1, floor: 3}, status: http.StatusGone, code: codeCompacted},
+		{name: "future", err: &FutureRevisionError{rev: 9, current: 3}, status: http.StatusBadRequest, code: codeFutureRevision},
+		{name: "transaction", err: &TxnError{at: "check 0", err: &PreconditionError{key: "a"}}, status: http.StatusPreconditionFailed, code: codePreconditionFailed},
+		{name: "unauthorized", err: &UnauthorizedError{err: errNoToken}, status: http.StatusUnauthorized, code: codeUnauthorized},
+		{name: "forbidden", err: &ForbiddenError{name: "ci", permission: permWrite, key: "a"}, status: http.StatusForbidden, code: codeForbidden},
+		{
+			name: "transaction forbidden", err: &TxnError{at: "operation 0", err: &ForbiddenError{name: "ci", permission: permWrite, key: "a"}},
+			status: http.StatusForbidden, code: codeForbidden,
+		},
+		{name: "too many", err: &TooManyOpsError{maxOps: maxBatchOps}, status: http.StatusRequestEntityTooLarge, code: codeTooManyOps, limit: limit(maxBatchOps)},
+		{
+			name: "body too large", err: &RequestError{err: &http.MaxBytesError{Limit: maxBatchBytes}},
+			status: http.StatusRequestEntityTooLarge, code: codeBodyTooLarge, limit: limit(maxBatchBytes),
+		},
+		{name: "request", err: &RequestError{err: fmt.Errorf("error: bad")}, status: http.StatusBadRequest, code: codeInvalidRequest},
+		{name: "unsupported", err: &UnsupportedError{feature: "watches"}, status: http.StatusNotImplemented, code: codeNotImplemented},
+		{name: "internal", err: fmt.Errorf("disk on fire"), status: http.StatusInternalServerError, code: codeInternal},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			p := problemOf(tt.err)
+			is.Equal(p.Status, tt.status)
+			is.Equal(p.Code, tt.code)
+			is.Equal(p.Limit, tt.limit)
+			is.Equal(p.Title, http.StatusText(tt.status))
+			is.Equal(p.Detail, tt.err.Error())
+		})
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	t.Parallel()
+	limit := func(n int) *int { return &n }
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   problem
+		allow  string
+	}{
+		{
+			name: "key too long", method: http.MethodPut, path: "/v1/keys/" + strings.Repeat("k", 20), body: "1",
+			want: problem{
+				Status: http.StatusRequestEntityTooLarge, Code: codeKeyTooLong, Limit: limit(20),
+				Detail: (&KeyError{maxLen: 20}).Error(),
+			},
+		},
+		{
+			name: "not found", method: http.MethodGet, path: "/v1/keys/missing",
+			want: problem{Status: http.StatusNotFound, Code: codeNotFound, Key: "missing", Detail: (&NoEntryError{key: "missing"}).Error()},
+		},
+		{
+			name: "invalid ttl", method: http.MethodPut, path: "/v1/keys/a?ttl=x", body: "1",
+			want: problem{Status: http.StatusBadRequest, Code: codeInvalidRequest, Detail: `error: ttl "x" is not a positive duration like "30s"`},
+		},
+		{
+			name: "unknown route", method: http.MethodGet, path: "/v1/test",
+			want: problem{Status: http.StatusNotFound, Code: codeNotFound, Detail: "error: there is no route /v1/test"},
+		},
+		{
+			name: "method", method: http.MethodPost, path: "/limits",
+			want:  problem{Status: http.StatusMethodNotAllowed, Code: codeMethodNotAllowed, Detail: "error: /limits only supports GET, HEAD"},
+			allow: "GET, HEAD",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{})
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.want.Status)
+			is.Equal(w.Header().Get("Content-Type"), problemMediaType)
+			is.Equal(w.Header().Get("Allow"), tt.allow)
+			var got problem
+			is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+			tt.want.Type, tt.want.Title, tt.want.Instance = "about:blank", http.StatusText(tt.want.Status), req.URL.Path
+			is.Equal(got, tt.want)
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// scanOptions selects the keys of a scan.
+// Keys are returned in ascending order, start is inclusive and end exclusive.
+type scanOptions struct {
+	prefix string
+	start  string
+	// end is the first key after the range, empty for no end
+	end    string
+	limit  int
+	values bool
+}
+
+func (o scanOptions) match(key string) bool {
+	return strings.HasPrefix(key, o.prefix) && key >= o.start && (o.end == "" || key < o.end)
+}
+
+// scanPage is a page of a scan.
+// If there are more keys, more is set and next is the first key of the following page.
+type scanPage struct {
+	entries []snapshotEntry
+	next    string
+	more    bool
+}
+
+// paginate returns the first limit of the sorted keys and the page without values.
+func paginate(keys []string, limit int) ([]string, scanPage) {
+	var page scanPage
+	if len(keys) > limit {
+		page.next, page.more = keys[limit], true
+		keys = keys[:limit]
+	}
+	page.entries = make([]snapshotEntry, 0, len(keys))
+	return keys, page
+}
+
+// The cursor is the first key of the next page. As keys may hold any bytes, it is encoded.
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("error: cursor %q is invalid", cursor) //nolint:goerr113
+	}
+	return string(key), nil
+}
+
+// parseScanOptions reads the prefix, start, end, limit, cursor and values query parameters.
+// A cursor continues a previous scan, so it moves the start of the range.
+func parseScanOptions(r *http.Request) (scanOptions, error) {
+	q := r.URL.Query()
+	opts := scanOptions{
+		prefix: q.Get("prefix"),
+		start:  q.Get("start"),
+		end:    q.Get("end"),
+		limit:  defaultScanLimit,
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxScanLimit {
+			return opts, fmt.Errorf("error: limit %q is not a number between 1 and %d", v, maxScanLimit) //nolint:goerr113
+		}
+		opts.limit = limit
+	}
+	if v := q.Get("values"); v != "" {
+		values, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("error: values %q is not a boolean", v) //nolint:goerr113
+		}
+		opts.values = values
+	}
+	if v := q.Get("cursor"); v != "" {
+		next, err := decodeCursor(v)
+		if err != nil {
+			return opts, err
+		}
+		if next > opts.start {
+			opts.start = next
+		}
+	}
+	return opts, nil
+}
+
+type scanItem struct {
+	Key      string  `json:"key"`
+	Value    *string `json:"value,omitempty"`
+	Encoding string  `json:"encoding,omitempty"`
+	ETag     string  `json:"etag,omitempty"`
+}
+
+type scanResponse struct {
+	Keys []scanItem `json:"keys"`
+	// Cursor continues the scan, it is empty on the last page
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// handleKeys lists the keys in a range, sorted and paginated.
+func (s *server) handleKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseScanOptions(r)
+		if err != nil {
+			s.writeError(w, r, &RequestError{err: err})
+			return
+		}
+		if err := s.authorize(r, opts.prefix, permRead); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		page, err := s.store(r).scan(opts)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		resp := scanResponse{Keys: make([]scanItem, 0, len(page.entries))}
+		for _, e := range page.entries {
+			item := scanItem{Key: e.key}
+			if opts.values {
+				item.Value, item.Encoding = jsonValue(e.value)
+				item.ETag = formatETag(e.version)
+			}
+			resp.Keys = append(resp.Keys, item)
+		}
+		if page.more {
+			resp.Cursor = encodeCursor(page.next)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			s.log.Info("Error writing response", "error", err)
+		}
+	}
+}
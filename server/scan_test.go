@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestStoreScan(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		opts scanOptions
+		want []string
+		next string
+	}{
+		{name: "all", opts: scanOptions{limit: 10}, want: []string{"", "a", "a/1", "a/2", "b", "c"}},
+		{name: "prefix", opts: scanOptions{prefix: "a/", limit: 10}, want: []string{"a/1", "a/2"}},
+		{name: "range", opts: scanOptions{start: "a/", end: "c", limit: 10}, want: []string{"a/1", "a/2", "b"}},
+		{name: "page", opts: scanOptions{limit: 2}, want: []string{"", "a"}, next: "a/1"},
+		{name: "last page", opts: scanOptions{start: "b", limit: 2}, want: []string{"b", "c"}},
+	}
+	for name, open := range testStores(defaultLimits()) {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			s := open(t)
+			for _, key := range []string{"c", "a/2", "a", "", "b", "a/1"} {
+				if _, _, err := s.put(key, "value of "+key, putOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, tt := range tests {
+				tt := tt
+				t.Run(tt.name, func(t *testing.T) {
+					is := is.New(t)
+					tt.opts.values = true
+					page, err := s.scan(tt.opts)
+					is.NoErr(err)
+					keys := make([]string, 0, len(page.entries))
+					for _, e := range page.entries {
+						is.Equal(e.value, "value of "+e.key)
+						keys = append(keys, e.key)
+					}
+					is.Equal(keys, tt.want)
+					is.Equal(page.more, tt.next != "")
+					is.Equal(page.next, tt.next)
+				})
+			}
+		})
+	}
+}
+
+func TestKeys(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		query  string
+		code   int
+		keys   []string
+		values bool
+		more   bool
+	}{
+		{name: "all", query: "", code: http.StatusOK, keys: []string{"a", "b", "c", "d"}},
+		{name: "prefix", query: "?prefix=c", code: http.StatusOK, keys: []string{"c"}},
+		{name: "values", query: "?start=b&end=d&values=true", code: http.StatusOK, keys: []string{"b", "c"}, values: true},
+		{name: "page", query: "?limit=3", code: http.StatusOK, keys: []string{"a", "b", "c"}, more: true},
+		{name: "cursor", query: "?cursor=Yw", code: http.StatusOK, keys: []string{"c", "d"}},
+		{name: "invalid limit", query: "?limit=0", code: http.StatusBadRequest},
+		{name: "invalid cursor", query: "?cursor=!", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			s := testServer(map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"})
+			req := httptest.NewRequest(http.MethodGet, "/keys"+tt.query, nil)
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var resp scanResponse
+			is.NoErr(json.NewDecoder(w.Body).Decode(&resp))
+			keys := make([]string, 0, len(resp.Keys))
+			for _, item := range resp.Keys {
+				keys = append(keys, item.Key)
+				is.Equal(item.Value != nil, tt.values)
+			}
+			is.Equal(keys, tt.keys)
+			is.Equal(resp.Cursor != "", tt.more)
+		})
+	}
+}
+
+func TestKeysWalk(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	s := testServer(map[string]string{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5"})
+	s.routes()
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		is.True(pages < 5)
+		req := httptest.NewRequest(http.MethodGet, "/keys?limit=2&cursor="+cursor, nil)
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, req)
+		is.Equal(w.Code, http.StatusOK)
+		var resp scanResponse
+		is.NoErr(json.NewDecoder(w.Body).Decode(&resp))
+		for _, item := range resp.Keys {
+			keys = append(keys, item.Key)
+		}
+		if resp.Cursor == "" {
+			break
+		}
+		cursor = resp.Cursor
+	}
+	is.Equal(keys, []string{"a", "b", "c", "d", "e"})
+}
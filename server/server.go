@@ -1,9 +1,14 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,105 +16,264 @@ import (
 	"golang.org/x/exp/slog"
 )
 
+const (
+	ttlHeader = "X-TTL"
+	// defaultContentType is sent for values stored without a Content-Type
+	defaultContentType = "application/octet-stream"
+	// maxContentLen is the maximum length of a stored Content-Type or Content-Encoding
+	maxContentLen = 256
+)
+
 type server struct {
 	log                  *slog.Logger
-	db                   *database
+	db                   Store
+	limits               limits
+	ns                   *namespaces
 	mux                  *http.ServeMux
 	requestCounterMetric prometheus.Counter
+	// auth authenticates the requests, nil serves everyone
+	auth *authenticator
+}
+
+// route is a handler of the API with its method pattern.
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+	// public routes are served without a token
+	public bool
+}
+
+// apiRoutes returns the routes of the versioned API, each one is described in openapi.json.
+// The routes of keys are served in every namespace as well, e.g. /v1/ns/{ns}/keys/{key...}.
+func (s *server) apiRoutes() []route {
+	routes := []route{
+		{pattern: "GET /v1/keys/{key...}", handler: s.handleKey()},
+		{pattern: "HEAD /v1/keys/{key...}", handler: s.handleKey()},
+		{pattern: "PUT /v1/keys/{key...}", handler: s.handleKey()},
+		{pattern: "DELETE /v1/keys/{key...}", handler: s.handleKey()},
+		{pattern: "PATCH /v1/keys/{key...}", handler: s.handleKey()},
+		{pattern: "GET /v1/keys", handler: s.handleKeys()},
+		{pattern: "POST /v1/batch", handler: s.handleBatch()},
+		{pattern: "POST /v1/txn", handler: s.handleTxn()},
+		{pattern: "GET /v1/watch", handler: s.handleWatch()},
+		{pattern: "GET /v1/changes", handler: s.handleChanges()},
+		{pattern: "GET /v1/history", handler: s.handleHistory()},
+		{pattern: "GET /v1/limits", handler: s.handleLimits()},
+		{pattern: "GET /v1/openapi.json", handler: s.handleOpenAPI(), public: true},
+		{pattern: "GET /v1/ns", handler: s.adminOnly(s.handleNamespaces())},
+		{pattern: "GET /v1/ns/{ns}", handler: s.adminOnly(s.handleNamespace())},
+		{pattern: "PUT /v1/ns/{ns}", handler: s.adminOnly(s.handleCreateNamespace())},
+		{pattern: "DELETE /v1/ns/{ns}", handler: s.adminOnly(s.handleDeleteNamespace())},
+	}
+	for _, rt := range routes {
+		method, path, _ := strings.Cut(rt.pattern, " ")
+		if _, ok := namespacedPaths[path]; ok {
+			routes = append(routes, route{pattern: method + " " + namespacePath(path), handler: s.inNamespace(rt.handler)})
+		}
+	}
+	return routes
+}
+
+// namespacedPaths are the /v1 paths that are also served in every namespace.
+var namespacedPaths = map[string]struct{}{ //nolint:gochecknoglobals
+	"/v1/keys/{key...}": {}, "/v1/keys": {}, "/v1/batch": {}, "/v1/txn": {},
+	"/v1/watch": {}, "/v1/changes": {}, "/v1/history": {}, "/v1/limits": {},
+}
+
+// namespacePath returns the path of a /v1 path in the namespace of the ns path value.
+func namespacePath(path string) string {
+	return "/v1/ns/{ns}" + strings.TrimPrefix(path, "/v1")
 }
 
+// routes registers the handlers with method patterns, so the mux answers requests with an
+// unsupported method with 405 Method Not Allowed and an Allow header, and unknown paths with 404.
+// The routes from before /v1 are kept as deprecated aliases.
 func (s *server) routes() {
-	s.mux.HandleFunc("/db", s.metricsMiddleware(s.requestLoggerMiddleware(s.handleDB())))
+	for _, rt := range s.apiRoutes() {
+		hf := rt.handler
+		if !rt.public {
+			hf = s.authenticated(hf)
+		}
+		s.mux.HandleFunc(rt.pattern, s.metricsMiddleware(s.requestLoggerMiddleware(hf)))
+		method, path, _ := strings.Cut(rt.pattern, " ")
+		if _, ok := legacyPaths[path]; ok {
+			alias := method + " " + strings.TrimPrefix(path, "/v1")
+			s.mux.HandleFunc(alias, s.metricsMiddleware(s.requestLoggerMiddleware(deprecated(path, hf))))
+		}
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		s.mux.HandleFunc(method+" /db", s.metricsMiddleware(s.requestLoggerMiddleware(s.authenticated(s.handleDB()))))
+	}
 	s.registerMetrics()
+}
+
+// legacyPaths are the /v1 paths that are also served without the prefix, as they were before /v1.
+var legacyPaths = map[string]struct{}{ //nolint:gochecknoglobals
+	"/v1/keys": {}, "/v1/batch": {}, "/v1/txn": {}, "/v1/watch": {}, "/v1/changes": {}, "/v1/history": {}, "/v1/limits": {},
+}
+
+// deprecated marks the responses of an alias as deprecated in favour of the successor path.
+func deprecated(successor string, hf http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		hf(w, r)
+	}
+}
 
-	s.mux.HandleFunc("/*", s.handleBadPath())
+// handleKey serves the entry whose key is the rest of the path, e.g. /v1/keys/config/a.
+// Keys with empty, "." or ".." segments must escape their slashes as %2F, the mux cleans the path otherwise.
+func (s *server) handleKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.handleEntry(w, r, r.PathValue("key"))
+	}
 }
 
+// handleDB serves the entry of the key query parameter.
+// Deprecated: it's kept as an alias of /v1/keys/{key} for old clients.
 func (s *server) handleDB() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		key := r.URL.Query().Get("key")
-		switch r.Method {
-		case http.MethodDelete:
-			s.handleDelete(w, key)
-		case http.MethodGet:
-			s.handleGet(w, key)
-		case http.MethodPut:
-			s.handlePut(w, r, key)
-		default:
-			s.handleNotImplemented(w)
-		}
+		deprecated(keyPath(key), func(w http.ResponseWriter, r *http.Request) {
+			s.handleEntry(w, r, key)
+		})(w, r)
 	}
 }
 
-func (s *server) handleDelete(w http.ResponseWriter, key string) {
-	err := s.db.delete(key)
-	var noEntryErr *NoEntryError
-	switch {
-	case errors.As(err, &noEntryErr):
-		w.WriteHeader(http.StatusNotFound)
-	case err != nil:
-		w.WriteHeader(http.StatusInternalServerError)
-	default:
-		w.WriteHeader(http.StatusOK)
+func (s *server) handleEntry(w http.ResponseWriter, r *http.Request, key string) {
+	perms := []string{permissionOf(r.Method)}
+	if r.Method == http.MethodPatch {
+		// the response of a patch reveals the value
+		perms = append(perms, permRead)
+	}
+	if err := s.authorize(r, key, perms...); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodDelete:
+		s.handleDelete(w, r, key)
+	case http.MethodGet, http.MethodHead:
+		s.handleGet(w, r, key)
+	case http.MethodPut:
+		s.handlePut(w, r, key)
+	case http.MethodPatch:
+		s.handlePatch(w, r, key)
+	}
+}
+
+// keyPath returns the path of the entry of key, slashes in the key are escaped.
+func keyPath(key string) string {
+	return "/v1/keys/" + url.PathEscape(key)
+}
+
+// handleLimits lets clients discover the limits enforced on keys, values and entries.
+func (s *server) handleLimits() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.limitsOf(r)); err != nil {
+			s.log.Info("Error writing response", "error", err)
+		}
 	}
 }
 
-func (s *server) handleGet(w http.ResponseWriter, key string) {
-	value, ok := s.db.get(key)
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
+func (s *server) handleDelete(w http.ResponseWriter, r *http.Request, key string) {
+	if err := s.store(r).delete(key, parsePrecondition(r)); err != nil {
+		s.writeError(w, r, err)
 		return
 	}
-	_, err := w.Write([]byte(value))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGet writes the value of key, or the value as of the revision in the rev query parameter.
+// HEAD requests get the same headers without the value, so clients can check if a key exists and its size.
+func (s *server) handleGet(w http.ResponseWriter, r *http.Request, key string) {
+	rev, err := parseRevision(r)
 	if err != nil {
+		s.writeError(w, r, &RequestError{err: err})
+		return
+	}
+	var e entry
+	if rev == 0 {
+		var ok bool
+		if e, ok, err = s.store(r).get(key); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		if !ok {
+			s.writeError(w, r, &NoEntryError{key: key})
+			return
+		}
+	} else {
+		hs, ok := s.store(r).(historian)
+		if !ok {
+			s.writeError(w, r, &UnsupportedError{feature: "reads at a revision"})
+			return
+		}
+		if e, err = hs.getAt(key, rev); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+	setContentHeaders(w, e.content)
+	setEntryHeaders(w, e)
+	if notModified(r, e.times.modified) {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write([]byte(e.value)); err != nil {
 		s.log.Info("Error writing response", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// setEntryHeaders sets the metadata headers of an entry: its ETag, size, revisions and times.
+// Entries written before the times were recorded have no Last-Modified.
+func setEntryHeaders(w http.ResponseWriter, e entry) {
+	w.Header().Set("ETag", formatETag(e.version))
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.value)))
+	w.Header().Set("X-Mod-Revision", strconv.FormatUint(e.version, 10))
+	if e.created > 0 {
+		w.Header().Set("X-Create-Revision", strconv.FormatUint(e.created, 10))
+	}
+	if !e.times.modified.IsZero() {
+		w.Header().Set("Last-Modified", e.times.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("X-Mod-Time", e.times.modified.UTC().Format(time.RFC3339Nano))
+	}
+	if !e.times.created.IsZero() {
+		w.Header().Set("X-Create-Time", e.times.created.UTC().Format(time.RFC3339Nano))
 	}
 }
 
 // according to rfc guidelines PUT should create or replace resources
 // https://www.rfc-editor.org/rfc/rfc2616#section-9.6
-func (s *server) handlePut(w http.ResponseWriter, r *http.Request, key string) { //nolint:cyclop
+func (s *server) handlePut(w http.ResponseWriter, r *http.Request, key string) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		s.log.Info("Error reading body", "error", err)
-		http.Error(w, "Error reading body", http.StatusBadRequest)
+		s.writeError(w, r, &RequestError{err: fmt.Errorf("error: can't read body: %w", err)})
 		return
 	}
-	code, err := s.db.put(key, string(body))
-	var keyErr *KeyError
-	var valueErr *ValueError
-	var dbErr *DatabaseError
-	switch {
-	case errors.As(err, &keyErr):
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		_, err = w.Write([]byte(err.Error()))
-		if err != nil {
-			s.log.Info(err.Error())
-		}
-		return
-	case errors.As(err, &valueErr):
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		_, err = w.Write([]byte(err.Error()))
-		if err != nil {
-			s.log.Info(err.Error())
-		}
+	ttl, err := parseTTL(r)
+	if err != nil {
+		s.writeError(w, r, &RequestError{err: err})
 		return
-	case errors.As(err, &dbErr):
-		w.WriteHeader(http.StatusInsufficientStorage)
-		_, err = w.Write([]byte(err.Error()))
-		if err != nil {
-			s.log.Info(err.Error())
-		}
+	}
+	c, err := parseContent(r)
+	if err != nil {
+		s.writeError(w, r, &RequestError{err: err})
 		return
-	case err != nil:
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err = w.Write([]byte(err.Error()))
-		if err != nil {
-			s.log.Info(err.Error())
-		}
+	}
+	code, version, err := s.store(r).put(key, string(body), putOptions{ttl: ttl, cond: parsePrecondition(r), content: c})
+	if err != nil {
+		s.writeError(w, r, err)
 		return
 	}
+	w.Header().Set("ETag", formatETag(version))
 	if code == http.StatusCreated {
 		w.WriteHeader(http.StatusCreated)
 	} else {
@@ -117,6 +281,59 @@ func (s *server) handlePut(w http.ResponseWriter, r *http.Request, key string) {
 	}
 }
 
+// parseTTL reads the optional TTL of a PUT from the ttl query parameter or the X-TTL header.
+// The TTL is a positive duration like "30s" or "1h".
+func parseTTL(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("ttl")
+	if v == "" {
+		v = r.Header.Get(ttlHeader)
+	}
+	if v == "" {
+		return 0, nil
+	}
+	return parseTTLValue(v)
+}
+
+func parseTTLValue(v string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("error: ttl %q is not a positive duration like \"30s\"", v) //nolint:goerr113
+	}
+	return ttl, nil
+}
+
+// parseContent reads the Content-Type and Content-Encoding of a PUT, which are stored with the value.
+func parseContent(r *http.Request) (content, error) {
+	c := content{typ: r.Header.Get("Content-Type"), encoding: r.Header.Get("Content-Encoding")}
+	return c, c.validate()
+}
+
+func (c content) validate() error {
+	if len(c.typ) > maxContentLen || len(c.encoding) > maxContentLen {
+		return fmt.Errorf("error: Content-Type and Content-Encoding must be shorter than %d", maxContentLen) //nolint:goerr113
+	}
+	if c.typ != "" {
+		if _, _, err := mime.ParseMediaType(c.typ); err != nil {
+			return fmt.Errorf("error: Content-Type %q is not a media type", c.typ) //nolint:goerr113
+		}
+	}
+	return nil
+}
+
+// setContentHeaders sets the stored content type and encoding of a value.
+// Values without a content type are sent as application/octet-stream, so the body is never sniffed.
+func setContentHeaders(w http.ResponseWriter, c content) {
+	typ := c.typ
+	if typ == "" {
+		typ = defaultContentType
+	}
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if c.encoding != "" {
+		w.Header().Set("Content-Encoding", c.encoding)
+	}
+}
+
 func (s *server) metricsMiddleware(hf http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s.requestCounterMetric.Inc()
@@ -129,19 +346,12 @@ func (s *server) requestLoggerMiddleware(hf http.HandlerFunc) http.HandlerFunc {
 		method := r.Method
 		path := r.URL.Path
 		key := r.URL.Query().Get("key")
+		if v := r.PathValue("key"); v != "" {
+			key = v
+		}
 		start := time.Now()
-		defer s.log.Info("request info", "method", method, "path", path, "key", key, "time in nanosec", time.Since(start))
 		hf(w, r)
-	}
-}
-
-func (s *server) handleNotImplemented(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusNotFound)
-}
-
-func (s *server) handleBadPath() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNotFound)
+		s.log.Info("request info", "method", method, "path", path, "namespace", r.PathValue("ns"), "key", key, "time in nanosec", time.Since(start))
 	}
 }
 
@@ -149,5 +359,20 @@ func (s *server) registerMetrics() {
 	s.log.Info("registering metrics")
 	r := prometheus.NewRegistry()
 	r.MustRegister(s.requestCounterMetric)
-	s.mux.Handle("/metrics", promhttp.HandlerFor(r, promhttp.HandlerOpts{})) //nolint:exhaustruct
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "database_size_bytes",
+		Help: "Total size of all keys and values in the database",
+	}, func() float64 { return float64(s.db.bytes()) }))
+	if e, ok := s.db.(evicter); ok {
+		r.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "database_evictions_total",
+			Help: "Count of entries evicted to make room for new ones",
+		}, func() float64 { return float64(e.evicted()) }))
+	}
+	if s.ns != nil {
+		r.MustRegister(s.ns)
+	}
+	// the metrics name the namespaces, so with tokens only admin tokens may read them
+	metrics := promhttp.HandlerFor(r, promhttp.HandlerOpts{}) //nolint:exhaustruct
+	s.mux.HandleFunc("GET /metrics", s.authenticated(s.adminOnly(metrics.ServeHTTP)))
 }
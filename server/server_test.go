@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
 	"github.com/prometheus/client_golang/prometheus"
@@ -127,6 +128,52 @@ func TestPut(t *testing.T) {
 	}
 }
 
+func TestPutContent(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		header   http.Header
+		body     string
+		code     int
+		wantType string
+	}{
+		{name: "json", header: http.Header{"Content-Type": {"application/json"}}, body: `{"a":1}`, code: http.StatusCreated, wantType: "application/json"},
+		{
+			name: "binary", header: http.Header{"Content-Type": {"application/octet-stream"}, "Content-Encoding": {"gzip"}},
+			body: "\x1f\x8b\x00\xff", code: http.StatusCreated, wantType: "application/octet-stream",
+		},
+		{name: "no type", body: "<b>x</b>", code: http.StatusCreated, wantType: defaultContentType},
+		{name: "invalid type", header: http.Header{"Content-Type": {"text/"}}, body: "x", code: http.StatusBadRequest},
+		{name: "type too long", header: http.Header{"Content-Type": {"text/" + strings.Repeat("x", maxContentLen)}}, body: "x", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{})
+
+			req := httptest.NewRequest(http.MethodPut, "/db?key=a", strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			if tt.code != http.StatusCreated {
+				return
+			}
+
+			w = httptest.NewRecorder()
+			s.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/db?key=a", nil))
+			is.Equal(w.Code, http.StatusOK)
+			is.Equal(w.Body.String(), tt.body)
+			is.Equal(w.Header().Get("Content-Type"), tt.wantType)
+			is.Equal(w.Header().Get("Content-Encoding"), tt.header.Get("Content-Encoding"))
+		})
+	}
+}
+
 func TestWrongPath(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -191,6 +238,27 @@ func TestDBFull(t *testing.T) {
 	}
 }
 
+func TestQuotaExceeded(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	s := testServer(map[string]string{})
+	db := newDatabase("", limits{KeyLen: defaultMaxKeyLen, ValueLen: defaultMaxValueLen, Entries: defaultMaxEntries, Bytes: 10})
+	_, _, err := db.put("a", "12345678", putOptions{})
+	is.NoErr(err)
+	s.db = db
+
+	req := httptest.NewRequest(http.MethodPut, "/db?key=b", strings.NewReader("12"))
+	w := httptest.NewRecorder()
+	s.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusInsufficientStorage)
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+	is.True(strings.Contains(w.Body.String(), "database_size_bytes 9"))
+}
+
 func TestParallel(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -233,17 +301,156 @@ func testServer(db map[string]string) *server {
 		Help: "Count of all HTTP requests",
 	})
 	log := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{AddSource: true}))
+	d := newDatabase("", defaultLimits())
+	for key, value := range db {
+		d.db[key] = entry{value: value}
+	}
 	return &server{
-		log: log,
-		db: &database{
-			db: db,
-		},
+		log:                  log,
+		db:                   d,
+		limits:               defaultLimits(),
+		ns:                   newNamespaces("", defaultLimits(), openMemoryNamespace),
 		mux:                  http.NewServeMux(),
 		requestCounterMetric: httpRequestsTotal,
 	}
 }
 
+// openMemoryNamespace opens the store of a namespace that is only kept in memory.
+func openMemoryNamespace(_ string, l limits) (Store, error) {
+	return newDatabase("", l), nil
+}
+
 func (s *server) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	s.routes()
-	s.mux.ServeHTTP(w, r)
+	s.ServeHTTP(w, r)
+}
+
+func TestKeyRoutes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+		want   string
+		allow  string
+	}{
+		{name: "get", method: http.MethodGet, path: "/v1/keys/test", code: http.StatusOK, want: succeeded},
+		{name: "get nested", method: http.MethodGet, path: "/v1/keys/config/a", code: http.StatusOK, want: "nested"},
+		{name: "get escaped", method: http.MethodGet, path: "/v1/keys/a%2F..%2Fx", code: http.StatusOK, want: "escaped"},
+		{name: "get missing", method: http.MethodGet, path: "/v1/keys/missing", code: http.StatusNotFound},
+		{name: "put", method: http.MethodPut, path: "/v1/keys/new", body: "1", code: http.StatusCreated},
+		{name: "put empty key", method: http.MethodPut, path: "/v1/keys/", body: "1", code: http.StatusCreated},
+		{name: "delete", method: http.MethodDelete, path: "/v1/keys/test", code: http.StatusOK},
+		{name: "post", method: http.MethodPost, path: "/v1/keys/test", code: http.StatusMethodNotAllowed, allow: "DELETE, GET, HEAD, PATCH, PUT"},
+		{name: "post alias", method: http.MethodPost, path: "/db?key=test", code: http.StatusMethodNotAllowed, allow: "DELETE, GET, HEAD, PUT"},
+		{name: "put batch", method: http.MethodPut, path: "/batch", code: http.StatusMethodNotAllowed, allow: "POST"},
+		{name: "unknown path", method: http.MethodGet, path: "/v1/test", code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := testServer(map[string]string{"test": succeeded, "config/a": "nested", "a/../x": "escaped"})
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			is.Equal(w.Header().Get("Allow"), tt.allow)
+			if tt.want != "" {
+				is.Equal(w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDBDeprecated(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	s := testServer(map[string]string{"a/b": succeeded})
+
+	req := httptest.NewRequest(http.MethodGet, "/db?key=a/b", nil)
+	w := httptest.NewRecorder()
+	s.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(w.Body.String(), succeeded)
+	is.Equal(w.Header().Get("Deprecation"), "true")
+	is.Equal(w.Header().Get("Link"), `</v1/keys/a%2Fb>; rel="successor-version"`)
+}
+
+func TestHead(t *testing.T) {
+	t.Parallel()
+	modified := time.Unix(1000, 500)
+	lastModified := modified.UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		header       map[string]string
+		code         int
+		want         string
+		size         string
+		lastModified string
+	}{
+		{name: "head", method: http.MethodHead, path: "/v1/keys/a", code: http.StatusOK, size: "5", lastModified: lastModified},
+		{name: "head missing", method: http.MethodHead, path: "/v1/keys/missing", code: http.StatusNotFound},
+		{name: "head alias", method: http.MethodHead, path: "/db?key=a", code: http.StatusOK, size: "5", lastModified: lastModified},
+		{name: "get", method: http.MethodGet, path: "/v1/keys/a", code: http.StatusOK, want: "hello", size: "5", lastModified: lastModified},
+		{
+			name: "not modified", method: http.MethodGet, path: "/v1/keys/a",
+			header: map[string]string{"If-Modified-Since": lastModified}, code: http.StatusNotModified, lastModified: lastModified,
+		},
+		{
+			name: "head not modified", method: http.MethodHead, path: "/v1/keys/a",
+			header: map[string]string{"If-Modified-Since": lastModified}, code: http.StatusNotModified, lastModified: lastModified,
+		},
+		{
+			name: "modified", method: http.MethodGet, path: "/v1/keys/a",
+			header: map[string]string{"If-Modified-Since": modified.Add(-time.Second).UTC().Format(http.TimeFormat)},
+			code:   http.StatusOK, want: "hello", size: "5", lastModified: lastModified,
+		},
+		{
+			name: "if-none-match wins", method: http.MethodGet, path: "/v1/keys/a",
+			header: map[string]string{"If-Modified-Since": lastModified, "If-None-Match": `"9"`},
+			code:   http.StatusOK, want: "hello", size: "5", lastModified: lastModified,
+		},
+		{
+			name: "invalid date", method: http.MethodGet, path: "/v1/keys/a",
+			header: map[string]string{"If-Modified-Since": "yesterday"}, code: http.StatusOK, want: "hello", size: "5", lastModified: lastModified,
+		},
+		{
+			name: "unknown time", method: http.MethodGet, path: "/v1/keys/old",
+			header: map[string]string{"If-Modified-Since": lastModified}, code: http.StatusOK, want: "old", size: "3",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			// old was written before the times were recorded
+			s := testServer(map[string]string{"old": "old"})
+			db := s.db.(*database)
+			db.now = (&fakeClock{t: modified}).now
+			_, _, err := db.put("a", "hello", putOptions{content: content{typ: "text/plain"}})
+			is.NoErr(err)
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			is.Equal(w.Header().Get("Last-Modified"), tt.lastModified)
+			if tt.code != http.StatusOK {
+				return
+			}
+			is.Equal(w.Body.String(), tt.want)
+			is.Equal(w.Header().Get("Content-Length"), tt.size)
+		})
+	}
 }
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// A snapshot file starts with a fixed size header followed by the payload.
+//
+//	magic    [4]byte "RKVS"
+//	version  uint16
+//	count    uint32 number of entries in the payload
+//	checksum uint32 crc32 (castagnoli) of the header without the checksum and the payload, of the payload before version 3
+//	length   uint64 length of the payload in bytes
+//	revision uint64 revision of the database, since version 2
+//
+// The payload is a sequence of records, each prefixed with its length as uvarint.
+// A record is a sequence of fields: a tag byte, the data length as uvarint and the data.
+// Decoders skip fields with unknown tags, so new fields can be added without a new version.
+// The version only changes for incompatible changes of the layout.
+const (
+	snapshotMagic        = "RKVS"
+	snapshotVersion      = 3
+	snapshotHeaderSizeV1 = 22
+	snapshotHeaderSize   = 30
+
+	fieldKey     byte = 1
+	fieldValue   byte = 2
+	fieldExpires byte = 4 // unix time in nanoseconds as uint64, only written for keys with a TTL
+	fieldVersion byte = 5 // revision of the last write as uint64
+	fieldCreated byte = 7 // revision that created the key as uint64
+
+	fieldContentType     byte = 8 // Content-Type of the value, only written if set
+	fieldContentEncoding byte = 9 // Content-Encoding of the value, only written if set
+
+	fieldCreatedAt  byte = 10 // unix time in nanoseconds the key was created as uint64, only written if known
+	fieldModifiedAt byte = 11 // unix time in nanoseconds of the last write as uint64, only written if known
+)
+
+var (
+	errSnapshotMagic    = errors.New("not a snapshot file")
+	errSnapshotChecksum = errors.New("checksum mismatch")
+	errSnapshotCount    = errors.New("entry count mismatch")
+	errRecordTruncated  = errors.New("record is truncated")
+	errRecordNoKey      = errors.New("record has no key")
+	errRecordField      = errors.New("record has an invalid field")
+	errSnapshotRevision = errors.New("entry is newer than the snapshot revision")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli) //nolint:gochecknoglobals
+)
+
+type snapshotVersionError struct {
+	version uint16
+}
+
+func (e *snapshotVersionError) Error() string {
+	return fmt.Sprintf("unsupported snapshot version %d, supported up to %d", e.version, snapshotVersion)
+}
+
+type snapshotEntry struct {
+	key     string
+	value   string
+	expires time.Time
+	version uint64
+	created uint64
+	content content
+	times   times
+}
+
+func encodeSnapshot(w io.Writer, rev uint64, entries []snapshotEntry) error {
+	var payload []byte
+	for _, e := range entries {
+		payload = appendRecord(payload, e)
+	}
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[4:], snapshotVersion)
+	binary.BigEndian.PutUint32(header[6:], uint32(len(entries)))
+	binary.BigEndian.PutUint64(header[14:], uint64(len(payload)))
+	binary.BigEndian.PutUint64(header[22:], rev)
+	binary.BigEndian.PutUint32(header[10:], snapshotChecksum(snapshotVersion, header, payload))
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("can't write snapshot header: %w", err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return fmt.Errorf("can't write snapshot payload: %w", err)
+	}
+	return nil
+}
+
+// decodeSnapshot returns the revision of the database and its entries.
+func decodeSnapshot(r io.Reader) (uint64, []snapshotEntry, error) {
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(r, header[:snapshotHeaderSizeV1]); err != nil {
+		return 0, nil, fmt.Errorf("can't read snapshot header: %w", err)
+	}
+	if !bytes.Equal(header[:4], []byte(snapshotMagic)) {
+		return 0, nil, errSnapshotMagic
+	}
+	version := binary.BigEndian.Uint16(header[4:])
+	if version > snapshotVersion {
+		return 0, nil, &snapshotVersionError{version: version}
+	}
+	var rev uint64
+	if version >= 2 { //nolint:gomnd
+		if _, err := io.ReadFull(r, header[snapshotHeaderSizeV1:]); err != nil {
+			return 0, nil, fmt.Errorf("can't read snapshot header: %w", err)
+		}
+		rev = binary.BigEndian.Uint64(header[22:])
+	} else {
+		header = header[:snapshotHeaderSizeV1]
+	}
+	count := binary.BigEndian.Uint32(header[6:])
+	checksum := binary.BigEndian.Uint32(header[10:])
+	length := binary.BigEndian.Uint64(header[14:])
+
+	// read one byte more than announced to detect trailing garbage
+	payload, err := io.ReadAll(io.LimitReader(r, int64(length)+1))
+	if err != nil {
+		return 0, nil, fmt.Errorf("can't read snapshot payload: %w", err)
+	}
+	if uint64(len(payload)) != length {
+		return 0, nil, fmt.Errorf("payload has %d bytes, header announced %d: %w", len(payload), length, errRecordTruncated)
+	}
+	if snapshotChecksum(version, header, payload) != checksum {
+		return 0, nil, errSnapshotChecksum
+	}
+
+	// the count of a version 1 or 2 header is not covered by the checksum, every record has at least one byte
+	entries := make([]snapshotEntry, 0, min(int(count), len(payload)))
+	for len(payload) > 0 {
+		var e snapshotEntry
+		e, payload, err = parseRecord(payload)
+		if err != nil {
+			return 0, nil, fmt.Errorf("entry %d: %w", len(entries), err)
+		}
+		if e.version > rev && version >= 2 {
+			return 0, nil, fmt.Errorf("entry %q: %w", e.key, errSnapshotRevision)
+		}
+		entries = append(entries, e)
+	}
+	if uint32(len(entries)) != count {
+		return 0, nil, errSnapshotCount
+	}
+	return rev, entries, nil
+}
+
+// snapshotChecksum returns the checksum of a snapshot of the version with the header and payload.
+// Since version 3 it covers the header without the checksum field, so a changed count or length is detected before it is used.
+func snapshotChecksum(version uint16, header []byte, payload []byte) uint32 {
+	if version < 3 { //nolint:gomnd
+		return crc32.Checksum(payload, castagnoli)
+	}
+	sum := crc32.Update(0, castagnoli, header[:10])
+	sum = crc32.Update(sum, castagnoli, header[14:])
+	return crc32.Update(sum, castagnoli, payload)
+}
+
+func appendRecord(b []byte, e snapshotEntry) []byte {
+	var rec []byte
+	rec = appendField(rec, fieldKey, []byte(e.key))
+	rec = appendField(rec, fieldValue, []byte(e.value))
+	rec = appendExpires(rec, e.expires)
+	rec = appendUint64(rec, fieldVersion, e.version)
+	rec = appendUint64(rec, fieldCreated, e.created)
+	rec = appendContent(rec, e.content)
+	rec = appendTimes(rec, e.times)
+	b = binary.AppendUvarint(b, uint64(len(rec)))
+	return append(b, rec...)
+}
+
+func appendExpires(b []byte, expires time.Time) []byte {
+	return appendTime(b, fieldExpires, expires)
+}
+
+// appendTime appends a time field in unix nanoseconds unless t is zero.
+func appendTime(b []byte, tag byte, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	return appendField(b, tag, binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano())))
+}
+
+func parseTime(data []byte) (time.Time, error) {
+	nanos, err := parseUint64(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(nanos)), nil
+}
+
+// appendContent appends the content type and encoding fields unless they are empty.
+func appendContent(b []byte, c content) []byte {
+	if c.typ != "" {
+		b = appendField(b, fieldContentType, []byte(c.typ))
+	}
+	if c.encoding != "" {
+		b = appendField(b, fieldContentEncoding, []byte(c.encoding))
+	}
+	return b
+}
+
+// appendTimes appends the created and modified times unless they are unknown.
+func appendTimes(b []byte, t times) []byte {
+	b = appendTime(b, fieldCreatedAt, t.created)
+	return appendTime(b, fieldModifiedAt, t.modified)
+}
+
+// appendUint64 appends a uint64 field unless v is zero.
+func appendUint64(b []byte, tag byte, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendField(b, tag, binary.BigEndian.AppendUint64(nil, v))
+}
+
+func parseUint64(data []byte) (uint64, error) {
+	if len(data) != 8 { //nolint:gomnd
+		return 0, errRecordField
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+func appendField(b []byte, tag byte, data []byte) []byte {
+	b = append(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// parseRecord parses the record at the start of b and returns the remaining bytes.
+func parseRecord(b []byte) (snapshotEntry, []byte, error) {
+	var e snapshotEntry
+	rec, rest, err := readChunk(b)
+	if err != nil {
+		return e, nil, err
+	}
+	hasKey := false
+	for len(rec) > 0 {
+		tag := rec[0]
+		var data []byte
+		data, rec, err = readChunk(rec[1:])
+		if err != nil {
+			return e, nil, err
+		}
+		switch tag {
+		case fieldKey:
+			e.key = string(data)
+			hasKey = true
+		case fieldValue:
+			e.value = string(data)
+		case fieldExpires:
+			if e.expires, err = parseTime(data); err != nil {
+				return e, nil, err
+			}
+		case fieldVersion:
+			if e.version, err = parseUint64(data); err != nil {
+				return e, nil, err
+			}
+		case fieldCreated:
+			if e.created, err = parseUint64(data); err != nil {
+				return e, nil, err
+			}
+		case fieldContentType:
+			e.content.typ = string(data)
+		case fieldContentEncoding:
+			e.content.encoding = string(data)
+		case fieldCreatedAt:
+			if e.times.created, err = parseTime(data); err != nil {
+				return e, nil, err
+			}
+		case fieldModifiedAt:
+			if e.times.modified, err = parseTime(data); err != nil {
+				return e, nil, err
+			}
+		}
+	}
+	if !hasKey {
+		return e, nil, errRecordNoKey
+	}
+	return e, rest, nil
+}
+
+// readChunk reads a uvarint length prefixed chunk from b and returns it and the remaining bytes.
+func readChunk(b []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return nil, nil, errRecordTruncated
+	}
+	end := size + int(n)
+	return b[size:end], b[end:], nil
+}
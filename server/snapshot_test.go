@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		entries []snapshotEntry
+	}{
+		{name: "empty", entries: []snapshotEntry{}},
+		{name: "single", entries: []snapshotEntry{{key: "a", value: "1"}}},
+		{name: "empty value", entries: []snapshotEntry{{key: "a", value: ""}}},
+		{
+			name: "weird values",
+			entries: []snapshotEntry{
+				{key: "a", value: "ntest!@#$%^&*({ }+=)-/\\/test_;'\""},
+				{key: "b", value: "\x00\xff\n"},
+				{key: "ü", value: "ö"},
+			},
+		},
+		{
+			name: "content",
+			entries: []snapshotEntry{
+				{key: "a", value: "{}", content: content{typ: "application/json"}},
+				{key: "b", value: "\x1f\x8b", content: content{typ: "text/plain", encoding: "gzip"}},
+			},
+		},
+		{
+			name: "times",
+			entries: []snapshotEntry{
+				{key: "a", value: "1", times: times{created: time.Unix(1000, 1), modified: time.Unix(2000, 2)}},
+				{key: "b", value: "2", times: times{modified: time.Unix(3000, 0)}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			var buf bytes.Buffer
+			is.NoErr(encodeSnapshot(&buf, 0, tt.entries))
+			_, entries, err := decodeSnapshot(&buf)
+			is.NoErr(err)
+			is.Equal(entries, tt.entries)
+		})
+	}
+}
+
+func TestSnapshotDecodeErrors(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	if err := encodeSnapshot(&buf, 0, []snapshotEntry{{key: "a", value: "1"}, {key: "b", value: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	modify := func(f func(b []byte) []byte) []byte {
+		b := append([]byte{}, valid...)
+		return f(b)
+	}
+	var versionErr *snapshotVersionError
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{name: "empty file", data: []byte{}},
+		{name: "json file", data: []byte(`{"a":"1"}`)},
+		{name: "bad magic", data: modify(func(b []byte) []byte { b[0] = 'X'; return b }), err: errSnapshotMagic},
+		{
+			name: "future version",
+			data: modify(func(b []byte) []byte { binary.BigEndian.PutUint16(b[4:], snapshotVersion+1); return b }),
+			err:  versionErr,
+		},
+		{
+			name: "flipped payload byte",
+			data: modify(func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b }),
+			err:  errSnapshotChecksum,
+		},
+		{name: "truncated payload", data: valid[:len(valid)-1], err: errRecordTruncated},
+		{name: "trailing garbage", data: append(append([]byte{}, valid...), 'x'), err: errRecordTruncated},
+		{
+			name: "flipped header byte",
+			data: modify(func(b []byte) []byte { b[snapshotHeaderSize-1] ^= 0xff; return b }),
+			err:  errSnapshotChecksum,
+		},
+		{
+			name: "wrong count",
+			data: modify(func(b []byte) []byte { binary.BigEndian.PutUint32(b[6:], 3); return b }),
+			err:  errSnapshotChecksum,
+		},
+		{
+			name: "wrong count in version 2",
+			data: modify(func(b []byte) []byte {
+				binary.BigEndian.PutUint32(b[6:], 3)
+				return withSnapshotVersion(b, 2)
+			}),
+			err: errSnapshotCount,
+		},
+		{
+			name: "huge count in version 2",
+			data: modify(func(b []byte) []byte {
+				binary.BigEndian.PutUint32(b[6:], 0xFFFFFFF0)
+				return withSnapshotVersion(b, 2)
+			}),
+			err: errSnapshotCount,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			_, _, err := decodeSnapshot(bytes.NewReader(tt.data))
+			is.True(err != nil)
+			switch target := tt.err.(type) { //nolint:errorlint
+			case nil:
+			case *snapshotVersionError:
+				is.True(errors.As(err, &target))
+			default:
+				is.True(errors.Is(err, tt.err))
+			}
+		})
+	}
+}
+
+func TestSnapshotSkipsUnknownFields(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	var rec []byte
+	rec = appendField(rec, fieldKey, []byte("a"))
+	rec = appendField(rec, 99, []byte("future"))
+	rec = appendField(rec, fieldValue, []byte("1"))
+	payload := binary.AppendUvarint(nil, uint64(len(rec)))
+	payload = append(payload, rec...)
+
+	e, rest, err := parseRecord(payload)
+	is.NoErr(err)
+	is.Equal(len(rest), 0)
+	is.Equal(e, snapshotEntry{key: "a", value: "1"})
+}
+
+func TestSnapshotVersion1(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	// version 1 has no revision in the header and no versions in the entries
+	var buf bytes.Buffer
+	is.NoErr(encodeSnapshot(&buf, 0, []snapshotEntry{{key: "a", value: "1"}}))
+
+	rev, entries, err := decodeSnapshot(bytes.NewReader(withSnapshotVersion(buf.Bytes(), 1)))
+	is.NoErr(err)
+	is.Equal(rev, uint64(0))
+	is.Equal(entries, []snapshotEntry{{key: "a", value: "1"}})
+}
+
+func TestSnapshotRevision(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	is.NoErr(encodeSnapshot(&buf, 7, []snapshotEntry{{key: "a", value: "1", version: 3}}))
+	rev, _, err := decodeSnapshot(bytes.NewReader(buf.Bytes()))
+	is.NoErr(err)
+	is.Equal(rev, uint64(7))
+
+	buf.Reset()
+	is.NoErr(encodeSnapshot(&buf, 2, []snapshotEntry{{key: "a", value: "1", version: 3}}))
+	_, _, err = decodeSnapshot(bytes.NewReader(buf.Bytes()))
+	is.True(errors.Is(err, errSnapshotRevision))
+}
+
+func TestSnapshotVersion2(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	// version 2 has a checksum of the payload only
+	var buf bytes.Buffer
+	is.NoErr(encodeSnapshot(&buf, 7, []snapshotEntry{{key: "a", value: "1", version: 3}}))
+
+	rev, entries, err := decodeSnapshot(bytes.NewReader(withSnapshotVersion(buf.Bytes(), 2)))
+	is.NoErr(err)
+	is.Equal(rev, uint64(7))
+	is.Equal(entries, []snapshotEntry{{key: "a", value: "1", version: 3}})
+}
+
+// withSnapshotVersion rewrites the snapshot b to the header and checksum of an older version.
+func withSnapshotVersion(b []byte, version uint16) []byte {
+	binary.BigEndian.PutUint16(b[4:], version)
+	binary.BigEndian.PutUint32(b[10:], crc32.Checksum(b[snapshotHeaderSize:], castagnoli))
+	if version == 1 {
+		b = append(b[:snapshotHeaderSizeV1], b[snapshotHeaderSize:]...)
+	}
+	return b
+}
@@ -0,0 +1,86 @@
+package main
+
+// Store is a storage backend of the server.
+// Implementations must be safe for concurrent use and enforce the key, value and entry limits.
+type Store interface {
+	// get returns the entry of key, expired entries don't exist.
+	// An error means the entry can't be read, not that it doesn't exist.
+	get(key string) (entry, bool, error)
+	// put returns http.StatusCreated for a new key and http.StatusOK for an update,
+	// and the version of the new entry. A failed precondition returns a PreconditionError.
+	put(key string, value string, opts putOptions) (int, uint64, error)
+	delete(key string, cond precondition) error
+	// batch runs the operations in order and returns a result for each.
+	// The operations are not atomic, every operation succeeds or fails on its own.
+	batch(ops []op) []opResult
+	// list returns all keys in ascending order.
+	list() []string
+	// scan returns a page of the keys selected by opts in ascending order,
+	// values may be left out unless opts.values is set.
+	scan(opts scanOptions) (scanPage, error)
+	// snapshot returns all entries in ascending key order.
+	snapshot() []snapshotEntry
+	// bytes returns the total length of all keys and values.
+	bytes() int
+	close() error
+}
+
+// persister is implemented by stores that only write to disk periodically.
+type persister interface {
+	persist() error
+}
+
+// reaper is implemented by stores that need to evict expired entries periodically.
+type reaper interface {
+	// reap removes all expired entries and returns how many were removed.
+	reap() int
+}
+
+// evicter is implemented by stores that evict entries when they are full.
+type evicter interface {
+	// evicted returns the number of entries evicted so far.
+	evicted() uint64
+}
+
+// transactor is implemented by stores that can apply transactions.
+type transactor interface {
+	// txn applies all ops of t or, if any check, precondition or limit fails, none.
+	// All writes of a transaction get the same revision.
+	txn(t txn) ([]opResult, error)
+}
+
+// watcher is implemented by stores that notify about changes.
+type watcher interface {
+	// watch returns the changes since opts.rev and subscribes to new ones.
+	watch(opts watchOptions) (*subscription, []change, error)
+	unwatch(sub *subscription)
+}
+
+// historian is implemented by stores that keep the previous values of keys.
+type historian interface {
+	// getAt returns the entry of key as of revision rev.
+	getAt(key string, rev uint64) (entry, error)
+	// revisions returns the known writes of key, oldest first, and if older ones were dropped.
+	revisions(key string) ([]keyRevision, bool, error)
+}
+
+// patcher is implemented by stores that can modify values atomically.
+type patcher interface {
+	// patch applies p to the value of key, see patch.
+	patch(key string, p patch, opts putOptions) (patchResult, error)
+}
+
+var (
+	_ Store       = (*database)(nil)
+	_ persister   = (*database)(nil)
+	_ reaper      = (*database)(nil)
+	_ evicter     = (*database)(nil)
+	_ lockedStore = (*database)(nil)
+	_ transactor  = (*database)(nil)
+	_ watcher     = (*database)(nil)
+	_ historian   = (*database)(nil)
+	_ patcher     = (*database)(nil)
+	_ Store       = (*dirStore)(nil)
+	_ reaper      = (*dirStore)(nil)
+	_ lockedStore = (*dirStore)(nil)
+)
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// testStores returns constructors for an empty store of every backend.
+func testStores(l limits) map[string]func(t *testing.T) Store {
+	return map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			t.Helper()
+			return newDatabase(filepath.Join(t.TempDir(), "database.snap"), l)
+		},
+		"dir": func(t *testing.T) Store {
+			t.Helper()
+			s, err := newDirStore(filepath.Join(t.TempDir(), "data"), l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+}
+
+func TestStores(t *testing.T) {
+	t.Parallel()
+	for name, open := range testStores(defaultLimits()) {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := open(t)
+
+			code, _, err := s.put("b", "1", putOptions{})
+			is.NoErr(err)
+			is.Equal(code, http.StatusCreated)
+			code, _, err = s.put("b", "2", putOptions{})
+			is.NoErr(err)
+			is.Equal(code, http.StatusOK)
+			_, _, err = s.put("a/../x", "", putOptions{})
+			is.NoErr(err)
+			_, _, err = s.put("", "empty key", putOptions{})
+			is.NoErr(err)
+
+			e, ok, _ := s.get("b")
+			is.True(ok)
+			is.Equal(e.value, "2")
+			_, ok, _ = s.get("missing")
+			is.True(!ok)
+
+			is.Equal(s.list(), []string{"", "a/../x", "b"})
+			snapshot := s.snapshot()
+			for i := range snapshot {
+				is.True(snapshot[i].version > 0)
+				is.True(snapshot[i].created > 0)
+				is.True(!snapshot[i].times.modified.IsZero())
+				snapshot[i].version, snapshot[i].created, snapshot[i].times = 0, 0, times{}
+			}
+			is.Equal(snapshot, []snapshotEntry{{key: "", value: "empty key"}, {key: "a/../x", value: ""}, {key: "b", value: "2"}})
+
+			is.NoErr(s.delete("b", precondition{}))
+			var noEntryErr *NoEntryError
+			is.True(errors.As(s.delete("b", precondition{}), &noEntryErr))
+
+			var keyErr *KeyError
+			_, _, err = s.put("tooooooooooooooolong", "v", putOptions{})
+			is.True(errors.As(err, &keyErr))
+			is.NoErr(s.close())
+		})
+	}
+}
+
+func TestDirStoreReopen(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	dir := filepath.Join(t.TempDir(), "data")
+	s, err := newDirStore(dir, defaultLimits())
+	is.NoErr(err)
+	for i := 0; i < 3; i++ {
+		_, _, err := s.put(strconv.Itoa(i), "v", putOptions{})
+		is.NoErr(err)
+	}
+	is.NoErr(s.close())
+	// an interrupted write leaves a temp file behind
+	is.NoErr(os.WriteFile(filepath.Join(dir, encodeFileName("0")+".tmp-1"), []byte("partial"), filePerm))
+
+	s, err = newDirStore(dir, defaultLimits())
+	is.NoErr(err)
+	is.Equal(s.count, 3)
+	e, ok, _ := s.get("0")
+	is.True(ok)
+	is.Equal(e.value, "v")
+	files, err := os.ReadDir(dir)
+	is.NoErr(err)
+	is.Equal(len(files), 3)
+}
+
+func TestStoreQuota(t *testing.T) {
+	t.Parallel()
+	l := defaultLimits()
+	l.Bytes = 10
+	for name, open := range testStores(l) {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			s := open(t)
+
+			_, _, err := s.put("a", "1234", putOptions{})
+			is.NoErr(err)
+			_, _, err = s.put("b", "1234", putOptions{})
+			is.NoErr(err)
+			is.Equal(s.bytes(), 10)
+
+			var quotaErr *QuotaError
+			_, _, err = s.put("c", "", putOptions{})
+			is.True(errors.As(err, &quotaErr))
+			_, _, err = s.put("a", "12345", putOptions{})
+			is.True(errors.As(err, &quotaErr))
+			_, _, err = s.put("a", "123", putOptions{})
+			is.NoErr(err)
+			is.Equal(s.bytes(), 9)
+
+			is.NoErr(s.delete("b", precondition{}))
+			is.Equal(s.bytes(), 4)
+			_, _, err = s.put("c", "12345", putOptions{})
+			is.NoErr(err)
+		})
+	}
+}
+
+func TestDirStoreLimits(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir := filepath.Join(t.TempDir(), "data")
+	s, err := newDirStore(dir, defaultLimits())
+	is.NoErr(err)
+	_, _, err = s.put("a-long-key", "a long value", putOptions{})
+	is.NoErr(err)
+
+	// the store is rejected if its entries violate lower limits
+	var keyErr *KeyError
+	l := defaultLimits()
+	l.KeyLen = 5
+	_, err = newDirStore(dir, l)
+	is.True(errors.As(err, &keyErr))
+	var valueErr *ValueError
+	l = defaultLimits()
+	l.ValueLen = 5
+	_, err = newDirStore(dir, l)
+	is.True(errors.As(err, &valueErr))
+}
+
+func TestDirStoreCorruptEntry(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir := filepath.Join(t.TempDir(), "data")
+	s, err := newDirStore(dir, defaultLimits())
+	is.NoErr(err)
+	_, _, err = s.put("a", "1", putOptions{})
+	is.NoErr(err)
+	is.NoErr(os.WriteFile(s.path("a"), []byte("corrupt"), filePerm))
+
+	// a corrupt entry is an error, not a missing key
+	_, ok, err := s.get("a")
+	is.True(err != nil)
+	is.True(!ok)
+	_, err = s.scan(scanOptions{limit: 10, values: true})
+	is.True(err != nil)
+	is.True(s.delete("a", precondition{}) != nil)
+
+	srv := testServer(map[string]string{})
+	srv.db = s
+	req := httptest.NewRequest(http.MethodGet, "/v1/keys/a", nil)
+	w := httptest.NewRecorder()
+	srv.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusInternalServerError)
+}
+
+func TestDirStoreLongKeys(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir := filepath.Join(t.TempDir(), "data")
+	l := defaultLimits()
+	l.KeyLen = 1000
+	s, err := newDirStore(dir, l)
+	is.NoErr(err)
+	long := strings.Repeat("k", 300)
+	_, _, err = s.put(long, "1", putOptions{})
+	is.NoErr(err)
+	_, _, err = s.put(long+"2", "2", putOptions{})
+	is.NoErr(err)
+	_, _, err = s.put("a", "3", putOptions{})
+	is.NoErr(err)
+	is.Equal(s.list(), []string{"a", long, long + "2"})
+
+	// the keys of hashed file names are read from the files on open
+	s, err = newDirStore(dir, l)
+	is.NoErr(err)
+	is.Equal(s.list(), []string{"a", long, long + "2"})
+	e, ok, err := s.get(long)
+	is.NoErr(err)
+	is.True(ok)
+	is.Equal(e.value, "1")
+	is.NoErr(s.delete(long+"2", precondition{}))
+	is.Equal(s.list(), []string{"a", long})
+
+	// a file that holds another key than its name is corrupt
+	b, err := os.ReadFile(s.path(long))
+	is.NoErr(err)
+	is.NoErr(os.WriteFile(s.path(long+"2"), b, filePerm))
+	_, err = newDirStore(dir, l)
+	is.True(errors.Is(err, errKeyMismatch))
+}
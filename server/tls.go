@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+var errTLSFlags = errors.New("-tls-cert and -tls-key must be set together, -client-ca needs both")
+
+// certReloader serves the certificate of the cert and key files and, with a client CA file,
+// only accepts clients with a certificate signed by one of its CAs.
+// reload replaces the files while connections are accepted, existing connections keep theirs.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	config       atomic.Pointer[tls.Config]
+}
+
+// loadCertReloader reads the PEM encoded certificate, key and optional client CA bundle.
+func loadCertReloader(certFile string, keyFile string, clientCAFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errTLSFlags
+	}
+	c := &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the files again, if one is invalid the previous certificates are kept.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("can't load certificate: %w", err)
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if c.clientCAFile != "" {
+		pool, err := loadCertPool(c.clientCAFile)
+		if err != nil {
+			return err
+		}
+		cfg.ClientCAs, cfg.ClientAuth = pool, tls.RequireAndVerifyClientCert
+	}
+	c.config.Store(cfg)
+	return nil
+}
+
+// tlsConfig returns the config of the server, every handshake uses the files of the last reload.
+// The protocols of the returned config are offered in every handshake, so HTTP/2 is negotiated.
+func (c *certReloader) tlsConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}}
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		loaded := c.config.Load().Clone()
+		loaded.NextProtos = cfg.NextProtos
+		return loaded, nil
+	}
+	return cfg
+}
+
+// loadCertPool reads a bundle of PEM encoded CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("CA bundle %s has no PEM certificates", path) //nolint:goerr113
+	}
+	return pool, nil
+}
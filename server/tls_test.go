@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// testCA issues certificates for the tests, its certificate is written to file.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	is := is.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	is.NoErr(err)
+	cert, err := x509.ParseCertificate(der)
+	is.NoErr(err)
+	file := filepath.Join(t.TempDir(), name+".pem")
+	is.NoErr(os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return testCA{cert: cert, key: key, file: file}
+}
+
+// issue writes a certificate for 127.0.0.1 signed by ca and its key to dir.
+// Server certificates are valid for servers, the others for clients.
+func (ca testCA) issue(t *testing.T, dir string, serial int64, server bool) (string, string) {
+	t.Helper()
+	is := is.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "rampu"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	is.NoErr(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	is.NoErr(err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	is.NoErr(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	is.NoErr(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+// serveTLS serves s over HTTPS with the config of certs the way run does and returns its address.
+func serveTLS(t *testing.T, s *server, certs *certReloader) string {
+	t.Helper()
+	is := is.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	s.routes()
+	srv := &http.Server{Handler: s, TLSConfig: certs.tlsConfig(), ReadHeaderTimeout: time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.ServeTLS(ln, "", ""); !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		srv.Close()
+		<-done
+	})
+	return "https://" + ln.Addr().String()
+}
+
+// tlsClient returns a client that trusts the CAs and sends the certificate, if any.
+func tlsClient(t *testing.T, cas []testCA, certFile string, keyFile string) *http.Client {
+	t.Helper()
+	is := is.New(t)
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: x509.NewCertPool()}
+	for _, ca := range cas {
+		cfg.RootCAs.AddCert(ca.cert)
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		is.NoErr(err)
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+}
+
+func TestTLS(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t, "ca")
+	other := newTestCA(t, "other")
+	certFile, keyFile := ca.issue(t, t.TempDir(), 2, true)
+	clientCert, clientKey := ca.issue(t, t.TempDir(), 3, false)
+	otherCert, otherKey := other.issue(t, t.TempDir(), 4, false)
+	tests := []struct {
+		name       string
+		clientCA   string
+		trusted    []testCA
+		clientCert string
+		clientKey  string
+		ok         bool
+	}{
+		{name: "tls", trusted: []testCA{ca}, ok: true},
+		{name: "untrusted server", trusted: []testCA{other}},
+		{name: "mtls", clientCA: ca.file, trusted: []testCA{ca}, clientCert: clientCert, clientKey: clientKey, ok: true},
+		{name: "mtls without client certificate", clientCA: ca.file, trusted: []testCA{ca}},
+		{name: "mtls with untrusted client certificate", clientCA: ca.file, trusted: []testCA{ca}, clientCert: otherCert, clientKey: otherKey},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			certs, err := loadCertReloader(certFile, keyFile, tt.clientCA)
+			is.NoErr(err)
+			url := serveTLS(t, testServer(map[string]string{"a": "1"}), certs)
+
+			resp, err := tlsClient(t, tt.trusted, tt.clientCert, tt.clientKey).Get(url + "/v1/keys/a")
+			if !tt.ok {
+				is.True(err != nil) // the handshake fails
+				return
+			}
+			is.NoErr(err)
+			defer resp.Body.Close()
+			is.Equal(resp.StatusCode, http.StatusOK)
+		})
+	}
+}
+
+func TestTLSProtocols(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue(t, t.TempDir(), 2, true)
+	clientCert, clientKey := ca.issue(t, t.TempDir(), 3, false)
+	tests := []struct {
+		name     string
+		clientCA string
+		protos   []string
+		major    int
+	}{
+		{name: "h2", protos: []string{"h2", "http/1.1"}, major: 2},
+		{name: "h2 with mtls", clientCA: ca.file, protos: []string{"h2", "http/1.1"}, major: 2},
+		{name: "http/1.1", protos: []string{"http/1.1"}, major: 1},
+		{name: "no alpn", major: 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			certs, err := loadCertReloader(certFile, keyFile, tt.clientCA)
+			is.NoErr(err)
+			url := serveTLS(t, testServer(map[string]string{"a": "1"}), certs)
+
+			client := tlsClient(t, []testCA{ca}, clientCert, clientKey)
+			transport := client.Transport.(*http.Transport) //nolint:forcetypeassert
+			transport.ForceAttemptHTTP2 = tt.major == 2
+			transport.TLSClientConfig.NextProtos = tt.protos
+			resp, err := client.Get(url + "/v1/keys/a")
+			is.NoErr(err)
+			defer resp.Body.Close()
+			is.Equal(resp.StatusCode, http.StatusOK)
+			is.Equal(resp.ProtoMajor, tt.major)
+		})
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	ca := newTestCA(t, "ca")
+	dir := t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, 2, true)
+	certs, err := loadCertReloader(certFile, keyFile, "")
+	is.NoErr(err)
+	url := serveTLS(t, testServer(map[string]string{}), certs)
+	serial := func() int64 {
+		resp, err := tlsClient(t, []testCA{ca}, "", "").Get(url + "/v1/limits")
+		is.NoErr(err)
+		defer resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	is.Equal(serial(), int64(2))
+
+	ca.issue(t, dir, 3, true)
+	is.NoErr(certs.reload())
+	is.Equal(serial(), int64(3)) // new connections get the new certificate
+
+	// an invalid key keeps the certificate
+	is.NoErr(os.WriteFile(keyFile, []byte("not a key"), 0o600))
+	is.True(certs.reload() != nil)
+	is.Equal(serial(), int64(3))
+}
+
+func TestLoadCertReloader(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue(t, t.TempDir(), 2, true)
+	otherCert, _ := ca.issue(t, t.TempDir(), 3, true)
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		clientCA string
+	}{
+		{name: "no key", cert: certFile},
+		{name: "client ca without certificate", clientCA: ca.file},
+		{name: "missing certificate", cert: filepath.Join(t.TempDir(), "missing.pem"), key: keyFile},
+		{name: "key of another certificate", cert: otherCert, key: keyFile},
+		{name: "client ca is no certificate", cert: certFile, key: keyFile, clientCA: keyFile},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			_, err := loadCertReloader(tt.cert, tt.key, tt.clientCA)
+			is.True(err != nil)
+		})
+	}
+}
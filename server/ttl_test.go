@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"golang.org/x/exp/slog"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestStoreTTL(t *testing.T) {
+	t.Parallel()
+	stores := map[string]func(t *testing.T, clock *fakeClock) Store{
+		"memory": func(t *testing.T, clock *fakeClock) Store {
+			t.Helper()
+			db := newDatabase(filepath.Join(t.TempDir(), "database.snap"), defaultLimits())
+			db.now = clock.now
+			return db
+		},
+		"dir": func(t *testing.T, clock *fakeClock) Store {
+			t.Helper()
+			s, err := newDirStore(filepath.Join(t.TempDir(), "data"), defaultLimits())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.now = clock.now
+			return s
+		},
+	}
+	for name, open := range stores {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			clock := &fakeClock{t: time.Unix(1000, 0)}
+			s := open(t, clock)
+
+			_, _, err := s.put("session", "token", putOptions{ttl: time.Minute})
+			is.NoErr(err)
+			_, _, err = s.put("forever", "v", putOptions{})
+			is.NoErr(err)
+			_, _, err = s.put("cleared", "v", putOptions{ttl: time.Second})
+			is.NoErr(err)
+			_, _, err = s.put("cleared", "v", putOptions{})
+			is.NoErr(err)
+
+			clock.t = clock.t.Add(59 * time.Second)
+			_, ok, _ := s.get("session")
+			is.True(ok)
+
+			clock.t = clock.t.Add(time.Second)
+			_, ok, _ = s.get("session")
+			is.True(!ok)
+			var noEntryErr *NoEntryError
+			is.True(errors.As(s.delete("session", precondition{}), &noEntryErr))
+			is.Equal(s.list(), []string{"cleared", "forever"})
+
+			r, ok := s.(reaper)
+			is.True(ok)
+			is.Equal(r.reap(), 1)
+			is.Equal(s.bytes(), len("forever")+len("v")+len("cleared")+len("v"))
+
+			code, _, err := s.put("session", "new", putOptions{})
+			is.NoErr(err)
+			is.Equal(code, http.StatusCreated)
+		})
+	}
+}
+
+func TestPersistRestoreTTL(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	path := filepath.Join(t.TempDir(), "database.snap")
+	db, err := openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.NoErr(err)
+	_, _, err = db.put("snapshotted", "v", putOptions{ttl: time.Hour})
+	is.NoErr(err)
+	is.NoErr(db.persist())
+	_, _, err = db.put("logged", "v", putOptions{ttl: time.Hour})
+	is.NoErr(err)
+	is.NoErr(db.wal.close())
+
+	restored, err := openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.NoErr(err)
+	defer restored.wal.close()
+	for _, key := range []string{"snapshotted", "logged"} {
+		is.True(restored.db[key].expires.Equal(db.db[key].expires))
+	}
+}
+
+func TestDirStoreReopenTTL(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	dir := filepath.Join(t.TempDir(), "data")
+	s, err := newDirStore(dir, defaultLimits())
+	is.NoErr(err)
+	_, _, err = s.put("a", "v", putOptions{ttl: time.Hour})
+	is.NoErr(err)
+
+	reopened, err := newDirStore(dir, defaultLimits())
+	is.NoErr(err)
+	is.True(reopened.expires["a"].Equal(s.expires["a"]))
+}
+
+func TestPutTTL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		query  string
+		header string
+		code   int
+	}{
+		{name: "no ttl", code: http.StatusCreated},
+		{name: "query", query: "&ttl=1m", code: http.StatusCreated},
+		{name: "header", header: "30s", code: http.StatusCreated},
+		{name: "invalid", query: "&ttl=soon", code: http.StatusBadRequest},
+		{name: "negative", header: "-1s", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			s := testServer(map[string]string{})
+			req := httptest.NewRequest(http.MethodPut, "/db?key=test"+tt.query, strings.NewReader("v"))
+			if tt.header != "" {
+				req.Header.Set(ttlHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+		})
+	}
+}
+
+func TestGetExpired(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	s := testServer(map[string]string{})
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	db := newDatabase("", defaultLimits())
+	db.now = clock.now
+	s.db = db
+	_, _, err := db.put("test", "v", putOptions{ttl: time.Second})
+	is.NoErr(err)
+	clock.t = clock.t.Add(time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/db?key=test", nil)
+	w := httptest.NewRecorder()
+	s.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusNotFound)
+}
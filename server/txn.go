@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// txn is a set of puts and deletes that is applied all-or-nothing.
+// The checks are evaluated first, then the ops in order, each op sees the effects of the previous ones.
+type txn struct {
+	checks []txnCheck
+	ops    []op
+}
+
+// txnCheck is a condition on the current entry of key.
+type txnCheck struct {
+	key  string
+	cond precondition
+	// value must be the current value if not nil, the key must exist then
+	value *string
+}
+
+// TxnError is the reason a transaction was rejected, at is the failed check or op.
+type TxnError struct {
+	at  string
+	err error
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("error: transaction failed at %s: %s", e.at, strings.TrimPrefix(e.err.Error(), "error: "))
+}
+
+func (e *TxnError) Unwrap() error {
+	return e.err
+}
+
+var errTxnOp = errors.New("error: transactions only support 'put' and 'delete'")
+
+func (db *database) txn(t txn) ([]opResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, c := range t.checks {
+		e, ok := db.lookup(c.key)
+		if !c.cond.check(e.version, ok) || (c.value != nil && (!ok || e.value != *c.value)) {
+			return nil, &TxnError{at: fmt.Sprintf("check %d", i), err: &PreconditionError{key: c.key}}
+		}
+	}
+
+	// staged holds the entries written by the transaction so far, nil marks a deleted key
+	staged := make(map[string]*entry)
+	view := func(key string) (entry, bool) {
+		if e, ok := staged[key]; ok {
+			if e == nil {
+				return entry{}, false
+			}
+			return *e, true
+		}
+		return db.lookup(key)
+	}
+	version := db.rev + 1
+	results := make([]opResult, len(t.ops))
+	records := make([]walRecord, 0, len(t.ops))
+	for i, o := range t.ops {
+		res, rec, err := db.stage(o, version, view)
+		if err != nil {
+			return nil, &TxnError{at: fmt.Sprintf("operation %d", i), err: err}
+		}
+		if rec.op == walOpPut {
+			e := db.entryOf(rec)
+			staged[o.key] = &e
+		} else {
+			staged[o.key] = nil
+		}
+		results[i] = res
+		records = append(records, rec)
+	}
+	if err := db.fitsStaged(staged); err != nil {
+		return nil, &TxnError{at: "commit", err: err}
+	}
+	if len(records) == 0 {
+		return results, nil
+	}
+	if err := db.log(walRecord{op: walOpTxn, records: records}); err != nil {
+		return nil, err
+	}
+	db.apply(records)
+	changes := make([]change, 0, len(records))
+	for _, r := range records {
+		changes = append(changes, changeOf(r))
+	}
+	db.notify(changes...)
+	return results, nil
+}
+
+// stage checks the op against the entries seen through view and returns its result and log record.
+// The caller must hold db.mu.
+func (db *database) stage(o op, version uint64, view func(string) (entry, bool)) (opResult, walRecord, error) {
+	current, ok := view(o.key)
+	switch o.kind {
+	case http.MethodPut:
+		if err := db.limits.validate(o.key, o.value); err != nil {
+			return opResult{}, walRecord{}, err
+		}
+		if !o.opts.cond.check(current.version, ok) {
+			return opResult{}, walRecord{}, &PreconditionError{key: o.key}
+		}
+		now := db.now().Round(0)
+		rec := walRecord{
+			op: walOpPut, key: o.key, value: o.value, version: version, created: version, content: o.opts.content,
+			times: times{created: now, modified: now},
+		}
+		if ok {
+			rec.created = current.created
+			rec.times.created = current.times.created
+		}
+		if o.opts.ttl > 0 {
+			rec.expires = now.Add(o.opts.ttl)
+		}
+		code := http.StatusOK
+		if !ok {
+			code = http.StatusCreated
+		}
+		return opResult{code: code, entry: db.entryOf(rec)}, rec, nil
+	case http.MethodDelete:
+		if !o.opts.cond.check(current.version, ok) {
+			return opResult{}, walRecord{}, &PreconditionError{key: o.key}
+		}
+		if !ok {
+			return opResult{}, walRecord{}, &NoEntryError{key: o.key}
+		}
+		return opResult{code: http.StatusOK}, walRecord{op: walOpDelete, key: o.key, version: version}, nil
+	default:
+		return opResult{}, walRecord{}, errTxnOp
+	}
+}
+
+// fitsStaged checks if the database stays within the entry and byte limits after writing
+// the staged entries. Transactions never evict entries. The caller must hold db.mu.
+func (db *database) fitsStaged(staged map[string]*entry) error {
+	count, size := len(db.db), db.size
+	for key, e := range staged {
+		if old, ok := db.db[key]; ok {
+			count--
+			size -= len(key) + len(old.value)
+		}
+		if e != nil {
+			count++
+			size += len(key) + len(e.value)
+		}
+	}
+	if count > db.limits.Entries && count > len(db.db) {
+		return &DatabaseError{maxLen: db.limits.Entries}
+	}
+	return db.limits.checkBytes(size)
+}
+
+// apply writes the records of a transaction, the caller must hold db.mu.
+func (db *database) apply(records []walRecord) {
+	for _, r := range records {
+		if r.version > db.rev {
+			db.rev = r.version
+		}
+		if r.op == walOpDelete {
+			db.remove(r.key, r.version)
+			continue
+		}
+		db.set(r.key, db.entryOf(r))
+	}
+}
+
+// replayTxn applies a transaction from the write-ahead log, the limits are checked on the result.
+func (db *database) replayTxn(records []walRecord) error {
+	var pending []walRecord
+	for _, r := range records {
+		if !db.contains(r) {
+			pending = append(pending, r)
+		}
+	}
+	records = pending
+	staged := make(map[string]*entry)
+	for _, r := range records {
+		if r.op == walOpDelete {
+			staged[r.key] = nil
+			continue
+		}
+		if err := db.limits.validate(r.key, r.value); err != nil {
+			return err
+		}
+		staged[r.key] = &entry{value: r.value}
+	}
+	if err := db.fitsStaged(staged); err != nil {
+		return err
+	}
+	db.apply(records)
+	return nil
+}
+
+// txnCheckRequest is a check in the body of a transaction request.
+type txnCheckRequest struct {
+	Key         string  `json:"key"`
+	Value       *string `json:"value,omitempty"`
+	Encoding    string  `json:"encoding,omitempty"`
+	IfMatch     string  `json:"ifMatch,omitempty"`
+	IfNoneMatch string  `json:"ifNoneMatch,omitempty"`
+}
+
+type txnRequest struct {
+	Checks []txnCheckRequest `json:"checks"`
+	Ops    []batchRequest    `json:"ops"`
+}
+
+type txnResponse struct {
+	Results []batchResponse `json:"results"`
+}
+
+// handleTxn applies the puts and deletes of the body all-or-nothing.
+// If the transaction is rejected, the status is the one of the failed check or operation.
+func (s *server) handleTxn() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := s.store(r).(transactor)
+		if !ok {
+			s.writeError(w, r, &UnsupportedError{feature: "transactions"})
+			return
+		}
+		var req txnRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&req); err != nil {
+			s.writeError(w, r, &RequestError{err: fmt.Errorf("error: body is not a transaction: %w", err)})
+			return
+		}
+		if len(req.Checks)+len(req.Ops) > maxBatchOps {
+			s.writeError(w, r, &TooManyOpsError{maxOps: maxBatchOps})
+			return
+		}
+		tx, err := req.txn()
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		if err := s.authorizeTxn(r, tx); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		results, err := t.txn(tx)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		resp := txnResponse{Results: make([]batchResponse, 0, len(results))}
+		for i, res := range results {
+			resp.Results = append(resp.Results, newBatchResponse(tx.ops[i].kind, res))
+		}
+		w.Header().Set("Content-Type", jsonMediaType)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			s.log.Info("Error writing response", "error", err)
+		}
+	}
+}
+
+// authorizeTxn checks that the token of the request may read the keys of the checks and apply the operations.
+func (s *server) authorizeTxn(r *http.Request, t txn) error {
+	for i, c := range t.checks {
+		if err := s.authorize(r, c.key, permRead); err != nil {
+			return &TxnError{at: fmt.Sprintf("check %d", i), err: err}
+		}
+	}
+	for i, o := range t.ops {
+		if err := s.authorize(r, o.key, permissionOf(o.kind)); err != nil {
+			return &TxnError{at: fmt.Sprintf("operation %d", i), err: err}
+		}
+	}
+	return nil
+}
+
+func (req txnRequest) txn() (txn, error) {
+	t := txn{checks: make([]txnCheck, 0, len(req.Checks)), ops: make([]op, 0, len(req.Ops))}
+	for i, c := range req.Checks {
+		check := txnCheck{key: c.Key}
+		if c.Value != nil {
+			value, err := parseJSONValue(*c.Value, c.Encoding)
+			if err != nil {
+				return t, &TxnError{at: fmt.Sprintf("check %d", i), err: &RequestError{err: err}}
+			}
+			check.value = &value
+		}
+		if c.IfMatch != "" {
+			check.cond.ifMatch = parseETagList([]string{c.IfMatch})
+		}
+		if c.IfNoneMatch != "" {
+			check.cond.ifNoneMatch = parseETagList([]string{c.IfNoneMatch})
+		}
+		t.checks = append(t.checks, check)
+	}
+	for i, r := range req.Ops {
+		o, err := r.op()
+		if err == nil && o.kind == http.MethodGet {
+			err = errTxnOp
+		}
+		if err != nil {
+			return t, &TxnError{at: fmt.Sprintf("operation %d", i), err: err}
+		}
+		t.ops = append(t.ops, o)
+	}
+	return t, nil
+}
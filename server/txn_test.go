@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/exp/slog"
+)
+
+func TestTxn(t *testing.T) {
+	t.Parallel()
+	one, two := "1", "2"
+	put := func(key, value string) op { return op{kind: http.MethodPut, key: key, value: value} }
+	del := func(key string) op { return op{kind: http.MethodDelete, key: key} }
+	tests := []struct {
+		name string
+		txn  txn
+		err  error
+		want map[string]string
+	}{
+		{
+			name: "applied",
+			txn:  txn{checks: []txnCheck{{key: "a", value: &one}}, ops: []op{put("a", "3"), put("c", "4"), del("b")}},
+			want: map[string]string{"a": "3", "c": "4"},
+		},
+		{
+			name: "ops see previous ops",
+			txn:  txn{ops: []op{put("c", "3"), del("c"), put("b", "5")}},
+			want: map[string]string{"a": "1", "b": "5"},
+		},
+		{
+			name: "value check failed",
+			txn:  txn{checks: []txnCheck{{key: "a", value: &two}}, ops: []op{put("a", "3")}},
+			err:  &PreconditionError{},
+		},
+		{
+			name: "value check on missing key",
+			txn:  txn{checks: []txnCheck{{key: "c", value: &one}}, ops: []op{put("a", "3")}},
+			err:  &PreconditionError{},
+		},
+		{
+			name: "version check failed",
+			txn: txn{
+				checks: []txnCheck{{key: "a", cond: precondition{ifMatch: etagList{present: true, versions: []uint64{2}}}}},
+				ops:    []op{put("a", "3")},
+			},
+			err: &PreconditionError{},
+		},
+		{
+			name: "create only",
+			txn: txn{ops: []op{
+				put("c", "3"),
+				{kind: http.MethodPut, key: "b", value: "3", opts: putOptions{cond: precondition{ifNoneMatch: etagList{present: true, any: true}}}},
+			}},
+			err: &PreconditionError{},
+		},
+		{name: "key too long", txn: txn{ops: []op{put("a", "3"), put("toooooooooooooooooooolong", "3")}}, err: &KeyError{}},
+		{name: "missing key", txn: txn{ops: []op{put("a", "3"), del("c")}}, err: &NoEntryError{}},
+		{name: "too many entries", txn: txn{ops: []op{put("c", "3"), put("d", "4")}}, err: &DatabaseError{}},
+		{name: "get", txn: txn{ops: []op{{kind: http.MethodGet, key: "a"}}}, err: errTxnOp},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			l := defaultLimits()
+			l.Entries = 3
+			db := newDatabase("", l)
+			_, _, err := db.put("a", "1", putOptions{})
+			is.NoErr(err)
+			_, _, err = db.put("b", "2", putOptions{})
+			is.NoErr(err)
+			before := db.snapshot()
+
+			results, err := db.txn(tt.txn)
+			if tt.err != nil {
+				var txnErr *TxnError
+				is.True(errors.As(err, &txnErr))
+				is.Equal(errorStatus(err), errorStatus(tt.err))
+				is.Equal(db.snapshot(), before)
+				is.Equal(db.rev, uint64(2))
+				return
+			}
+			is.NoErr(err)
+			is.Equal(len(results), len(tt.txn.ops))
+			got := make(map[string]string)
+			for _, e := range db.snapshot() {
+				got[e.key] = e.value
+			}
+			is.Equal(got, tt.want)
+			// all puts of a transaction share the version
+			is.Equal(db.rev, uint64(3))
+		})
+	}
+}
+
+func TestTxnRecovery(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	path := filepath.Join(t.TempDir(), "database.snap")
+	db, err := openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.NoErr(err)
+	_, _, err = db.put("a", "1", putOptions{})
+	is.NoErr(err)
+	_, err = db.txn(txn{ops: []op{
+		{kind: http.MethodPut, key: "b", value: "2"},
+		{kind: http.MethodDelete, key: "a"},
+	}})
+	is.NoErr(err)
+	is.NoErr(db.wal.f.Close())
+
+	restored, err := openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.NoErr(err)
+	is.Equal(len(restored.db), 1)
+	is.Equal(restored.db["b"].version, uint64(2))
+	is.Equal(restored.db, db.db)
+	is.NoErr(restored.wal.close())
+
+	// a torn transaction is dropped as a whole
+	b, err := os.ReadFile(walPath(path))
+	is.NoErr(err)
+	is.NoErr(os.WriteFile(walPath(path), b[:len(b)-1], filePerm))
+	restored, err = openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.NoErr(err)
+	defer restored.wal.close()
+	is.Equal(len(restored.db), 1)
+	is.Equal(restored.db["a"].value, "1")
+	is.Equal(restored.db["a"].version, uint64(1))
+}
+
+func TestTxnRequest(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		body string
+		code int
+		want txnResponse
+	}{
+		{
+			name: "applied",
+			body: `{"checks":[{"key":"exists","value":"exists"}],"ops":[{"op":"put","key":"a","value":"1"},{"op":"delete","key":"exists"}]}`,
+			code: http.StatusOK,
+			want: txnResponse{Results: []batchResponse{{Status: http.StatusCreated, ETag: `"1"`}, {Status: http.StatusOK}}},
+		},
+		{
+			name: "check failed",
+			body: `{"checks":[{"key":"exists","ifMatch":"\"3\""}],"ops":[{"op":"put","key":"a","value":"1"}]}`,
+			code: http.StatusPreconditionFailed,
+		},
+		{name: "value too long", body: `{"ops":[{"op":"put","key":"a","value":"` + strings.Repeat("a", 200) + `"}]}`, code: http.StatusRequestEntityTooLarge},
+		{
+			name: "binary value",
+			body: `{"checks":[{"key":"exists","value":"ZXhpc3Rz","encoding":"base64"}],"ops":[{"op":"put","key":"a","value":"//4A","encoding":"base64"}]}`,
+			code: http.StatusOK,
+			want: txnResponse{Results: []batchResponse{{Status: http.StatusCreated, ETag: `"1"`}}},
+		},
+		{name: "invalid check encoding", body: `{"checks":[{"key":"exists","value":"1","encoding":"hex"}],"ops":[]}`, code: http.StatusBadRequest},
+		{name: "get", body: `{"ops":[{"op":"get","key":"a"}]}`, code: http.StatusBadRequest},
+		{name: "invalid json", body: `[]`, code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			s := testServer(map[string]string{"exists": "exists"})
+			req := httptest.NewRequest(http.MethodPost, "/txn", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+			if tt.code != http.StatusOK {
+				_, ok, _ := s.db.get("a")
+				is.True(!ok)
+				return
+			}
+			var resp txnResponse
+			is.NoErr(json.NewDecoder(w.Body).Decode(&resp))
+			is.Equal(resp, tt.want)
+		})
+	}
+}
+
+func TestTxnUnsupported(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	s := testServer(map[string]string{})
+	store, err := newDirStore(filepath.Join(t.TempDir(), "data"), defaultLimits())
+	is.NoErr(err)
+	s.db = store
+	req := httptest.NewRequest(http.MethodPost, "/txn", strings.NewReader(`{}`))
+	w := httptest.NewRecorder()
+	s.serveHTTP(w, req)
+	is.Equal(w.Code, http.StatusNotImplemented)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// The write-ahead log is a sequence of records appended to <db-file>.wal.
+// Every record is framed as
+//
+//	length   uvarint length of the body
+//	checksum uint32 crc32 (castagnoli) of the body
+//	body     fields in the same tag, length, data encoding as snapshot records
+//
+// A last record that is cut off or fails its checksum marks a torn write,
+// the log is truncated there on replay. A bad record before the last one is corruption,
+// the log is not replayed then.
+// A transaction is a single record holding the bodies of its puts and deletes,
+// so it is replayed either completely or not at all.
+const (
+	fieldOp     byte = 3
+	fieldRecord byte = 6 // body of a record of a transaction
+
+	walOpPut    byte = 1
+	walOpDelete byte = 2
+	walOpTxn    byte = 3
+
+	walChecksumSize = 4
+)
+
+// syncPolicy defines when the write-ahead log is flushed to stable storage.
+// A positive value syncs on that interval.
+type syncPolicy time.Duration
+
+const (
+	syncAlways syncPolicy = 0
+	syncNever  syncPolicy = -1
+)
+
+var (
+	errWALChecksum = errors.New("checksum mismatch")
+	errWALRecord   = errors.New("invalid record")
+)
+
+// parseSyncPolicy parses "always", "never" or an interval like "100ms".
+func parseSyncPolicy(s string) (syncPolicy, error) {
+	switch s {
+	case "always":
+		return syncAlways, nil
+	case "never":
+		return syncNever, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid sync policy %q, use 'always', 'never' or a positive interval like '100ms'", s)
+	}
+	return syncPolicy(d), nil
+}
+
+type walRecord struct {
+	op      byte
+	key     string
+	value   string
+	expires time.Time
+	version uint64
+	created uint64
+	content content
+	times   times
+	// records are the puts and deletes of a transaction
+	records []walRecord
+}
+
+type wal struct {
+	mu     sync.Mutex
+	f      *os.File
+	policy syncPolicy
+	dirty  bool
+}
+
+func walPath(dbPath string) string {
+	return dbPath + ".wal"
+}
+
+// openWAL opens the log at path, passes every intact record to apply and
+// truncates a torn tail. It returns the number of replayed records and discarded bytes.
+// A corrupt record before the last one returns a WALError, the log is left untouched then.
+func openWAL(path string, policy syncPolicy, apply func(walRecord) error) (*wal, int, int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, 0, fmt.Errorf("can't read write-ahead log: %w", err)
+	}
+	records, offset := 0, 0
+	for offset < len(b) {
+		r, n, err := parseWALRecord(b[offset:])
+		// only the last record can be torn, it runs past the end or ends with the file
+		if err != nil && (n == 0 || offset+n == len(b)) {
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, &WALError{path: path, offset: offset, err: err}
+		}
+		if err := apply(r); err != nil {
+			return nil, 0, 0, fmt.Errorf("can't replay write-ahead log record %d: %w", records, err)
+		}
+		records++
+		offset += n
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, filePerm)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("can't open write-ahead log: %w", err)
+	}
+	if err := f.Truncate(int64(offset)); err != nil {
+		f.Close()
+		return nil, 0, 0, fmt.Errorf("can't truncate write-ahead log: %w", err)
+	}
+	return &wal{f: f, policy: policy}, records, len(b) - offset, nil
+}
+
+// append writes r to the log and, depending on the policy, syncs it before returning.
+func (w *wal) append(r walRecord) error {
+	body := appendWALBody(nil, r)
+	b := binary.AppendUvarint(nil, uint64(len(body)))
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(body, castagnoli))
+	b = append(b, body...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.f.Write(b); err != nil {
+		return fmt.Errorf("can't write to write-ahead log: %w", err)
+	}
+	if w.policy == syncAlways {
+		return w.syncLocked()
+	}
+	w.dirty = true
+	return nil
+}
+
+// sync flushes pending records to stable storage.
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	return w.syncLocked()
+}
+
+func (w *wal) syncLocked() error {
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("can't sync write-ahead log: %w", err)
+	}
+	w.dirty = false
+	return nil
+}
+
+// truncate drops all records, it's called once they are contained in a snapshot.
+func (w *wal) truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.f.Truncate(0); err != nil {
+		return fmt.Errorf("can't truncate write-ahead log: %w", err)
+	}
+	return w.syncLocked()
+}
+
+func (w *wal) close() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return fmt.Errorf("can't close write-ahead log: %w", err)
+	}
+	return nil
+}
+
+func appendWALBody(b []byte, r walRecord) []byte {
+	b = appendField(b, fieldOp, []byte{r.op})
+	switch r.op {
+	case walOpTxn:
+		for _, rec := range r.records {
+			b = appendField(b, fieldRecord, appendWALBody(nil, rec))
+		}
+	case walOpPut:
+		b = appendField(b, fieldKey, []byte(r.key))
+		b = appendField(b, fieldValue, []byte(r.value))
+		b = appendExpires(b, r.expires)
+		b = appendUint64(b, fieldVersion, r.version)
+		b = appendUint64(b, fieldCreated, r.created)
+		b = appendContent(b, r.content)
+		b = appendTimes(b, r.times)
+	default:
+		b = appendField(b, fieldKey, []byte(r.key))
+		b = appendUint64(b, fieldVersion, r.version)
+	}
+	return b
+}
+
+// parseWALRecord parses the record at the start of b and returns it and its size in bytes.
+// The size is also returned for a record with a bad checksum or body, it's 0 if the record runs past the end of b.
+func parseWALRecord(b []byte) (walRecord, int, error) {
+	var r walRecord
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) || uint64(len(b)-size)-n < walChecksumSize {
+		return r, 0, errRecordTruncated
+	}
+	checksum := binary.BigEndian.Uint32(b[size:])
+	start := size + walChecksumSize
+	end := start + int(n)
+	body := b[start:end]
+	if crc32.Checksum(body, castagnoli) != checksum {
+		return r, end, errWALChecksum
+	}
+	r, err := parseWALBody(body, true)
+	if err != nil {
+		return r, end, err
+	}
+	return r, end, nil
+}
+
+// parseWALBody parses the fields of a record, transactions are only valid at the top level.
+func parseWALBody(body []byte, top bool) (walRecord, error) {
+	var r walRecord
+	hasKey := false
+	for len(body) > 0 {
+		tag := body[0]
+		data, rest, err := readChunk(body[1:])
+		if err != nil {
+			return r, err
+		}
+		body = rest
+		switch tag {
+		case fieldOp:
+			if len(data) != 1 {
+				return r, errWALRecord
+			}
+			r.op = data[0]
+		case fieldKey:
+			r.key = string(data)
+			hasKey = true
+		case fieldValue:
+			r.value = string(data)
+		case fieldExpires:
+			if r.expires, err = parseTime(data); err != nil {
+				return r, err
+			}
+		case fieldVersion:
+			if r.version, err = parseUint64(data); err != nil {
+				return r, err
+			}
+		case fieldCreated:
+			if r.created, err = parseUint64(data); err != nil {
+				return r, err
+			}
+		case fieldContentType:
+			r.content.typ = string(data)
+		case fieldContentEncoding:
+			r.content.encoding = string(data)
+		case fieldCreatedAt:
+			if r.times.created, err = parseTime(data); err != nil {
+				return r, err
+			}
+		case fieldModifiedAt:
+			if r.times.modified, err = parseTime(data); err != nil {
+				return r, err
+			}
+		case fieldRecord:
+			rec, err := parseWALBody(data, false)
+			if err != nil {
+				return r, err
+			}
+			r.records = append(r.records, rec)
+		}
+	}
+	switch {
+	case r.op == walOpTxn && top && !hasKey:
+	case (r.op == walOpPut || r.op == walOpDelete) && hasKey && r.records == nil:
+	default:
+		return r, errWALRecord
+	}
+	return r, nil
+}
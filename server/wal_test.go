@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"golang.org/x/exp/slog"
+)
+
+func TestParseSyncPolicy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in     string
+		policy syncPolicy
+		isErr  bool
+	}{
+		{in: "always", policy: syncAlways},
+		{in: "never", policy: syncNever},
+		{in: "100ms", policy: syncPolicy(100 * time.Millisecond)},
+		{in: "0s", isErr: true},
+		{in: "sometimes", isErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.in, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			policy, err := parseSyncPolicy(tt.in)
+			if tt.isErr {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(policy, tt.policy)
+		})
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	path := filepath.Join(t.TempDir(), "database.snap")
+	db, err := openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.NoErr(err)
+	_, _, err = db.put("a", "1", putOptions{})
+	is.NoErr(err)
+	is.NoErr(db.persist())
+	_, _, err = db.put("b", "2", putOptions{})
+	is.NoErr(err)
+	_, _, err = db.put("a", "3", putOptions{})
+	is.NoErr(err)
+	is.NoErr(db.delete("b", precondition{}))
+	_, _, err = db.put("c", "4", putOptions{content: content{typ: "text/plain", encoding: "gzip"}})
+	is.NoErr(err)
+	// simulate a crash, the database is not persisted
+	is.NoErr(db.wal.f.Close())
+
+	restored, err := openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.NoErr(err)
+	defer restored.wal.close()
+	is.Equal(len(restored.db), 2)
+	is.Equal(restored.db["c"].content, content{typ: "text/plain", encoding: "gzip"})
+	// the entries are recovered with their versions, content and times
+	is.Equal(restored.db, db.db)
+	is.Equal(restored.rev, uint64(5))
+}
+
+func TestWALTruncatedByPersist(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	path := filepath.Join(t.TempDir(), "database.snap")
+	db, err := openDatabase(path, defaultLimits(), false, syncNever, log)
+	is.NoErr(err)
+	_, _, err = db.put("a", "1", putOptions{})
+	is.NoErr(err)
+	info, err := os.Stat(walPath(path))
+	is.NoErr(err)
+	is.True(info.Size() > 0)
+
+	is.NoErr(db.close())
+	info, err = os.Stat(walPath(path))
+	is.NoErr(err)
+	is.Equal(info.Size(), int64(0))
+}
+
+func TestWALTornTail(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "database.snap.wal")
+	w, _, _, err := openWAL(path, syncAlways, func(walRecord) error { return nil })
+	is.NoErr(err)
+	is.NoErr(w.append(walRecord{op: walOpPut, key: "a", value: "1"}))
+	is.NoErr(w.append(walRecord{op: walOpPut, key: "b", value: "2"}))
+	is.NoErr(w.close())
+	intact, err := os.Stat(path)
+	is.NoErr(err)
+
+	// the last record was only partially written
+	b, err := os.ReadFile(path)
+	is.NoErr(err)
+	is.NoErr(os.WriteFile(path, b[:len(b)-2], filePerm))
+
+	var replayed []walRecord
+	w, records, discarded, err := openWAL(path, syncAlways, func(r walRecord) error {
+		replayed = append(replayed, r)
+		return nil
+	})
+	is.NoErr(err)
+	defer w.close()
+	is.Equal(records, 1)
+	is.Equal(replayed, []walRecord{{op: walOpPut, key: "a", value: "1"}})
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(info.Size(), intact.Size()-2-int64(discarded))
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		record   int // index of the record whose last byte is flipped
+		corrupt  bool
+		replayed int
+	}{
+		{name: "first record", record: 0, corrupt: true},
+		{name: "middle record", record: 1, corrupt: true},
+		{name: "last record", record: 2, replayed: 2},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			path := filepath.Join(t.TempDir(), "database.snap.wal")
+			w, _, _, err := openWAL(path, syncAlways, func(walRecord) error { return nil })
+			is.NoErr(err)
+			var ends []int
+			for _, key := range []string{"a", "b", "c"} {
+				is.NoErr(w.append(walRecord{op: walOpPut, key: key, value: "1"}))
+				info, err := os.Stat(path)
+				is.NoErr(err)
+				ends = append(ends, int(info.Size()))
+			}
+			is.NoErr(w.close())
+			b, err := os.ReadFile(path)
+			is.NoErr(err)
+			b[ends[tt.record]-1] ^= 0xff
+			is.NoErr(os.WriteFile(path, b, filePerm))
+
+			records := 0
+			w, _, _, err = openWAL(path, syncAlways, func(walRecord) error {
+				records++
+				return nil
+			})
+			if tt.corrupt {
+				var walErr *WALError
+				is.True(errors.As(err, &walErr))
+				is.True(errors.Is(err, errWALChecksum))
+				// the log is kept for inspection
+				after, err := os.ReadFile(path)
+				is.NoErr(err)
+				is.Equal(after, b)
+				return
+			}
+			is.NoErr(err)
+			defer w.close()
+			is.Equal(records, tt.replayed)
+		})
+	}
+}
+
+func TestWALCorruptStartEmpty(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	path := filepath.Join(t.TempDir(), "database.snap")
+	db, err := openDatabase(path, defaultLimits(), false, syncAlways, log)
+	is.NoErr(err)
+	_, _, err = db.put("a", "1", putOptions{})
+	is.NoErr(err)
+	is.NoErr(db.persist())
+	_, _, err = db.put("b", "2", putOptions{})
+	is.NoErr(err)
+	_, _, err = db.put("c", "3", putOptions{})
+	is.NoErr(err)
+	is.NoErr(db.wal.f.Close())
+	b, err := os.ReadFile(walPath(path))
+	is.NoErr(err)
+	b[0] ^= 0x01 // the length of the first record
+	is.NoErr(os.WriteFile(walPath(path), b, filePerm))
+
+	_, err = openDatabase(path, defaultLimits(), false, syncAlways, log)
+	var walErr *WALError
+	is.True(errors.As(err, &walErr)) // the server refuses to start
+
+	restored, err := openDatabase(path, defaultLimits(), true, syncAlways, log)
+	is.NoErr(err)
+	defer restored.wal.close()
+	is.Equal(len(restored.db), 1) // the snapshot alone
+	_, err = os.Stat(walPath(path) + ".corrupt")
+	is.NoErr(err)
+}
+
+func TestWALNotTruncatedAfterSnapshot(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	l := defaultLimits()
+	l.Entries = 1
+
+	path := filepath.Join(t.TempDir(), "database.snap")
+	db, err := openDatabase(path, l, false, syncAlways, log)
+	is.NoErr(err)
+	_, _, err = db.put("a", "1", putOptions{})
+	is.NoErr(err)
+	is.NoErr(db.delete("a", precondition{}))
+	_, err = db.txn(txn{ops: []op{{kind: http.MethodPut, key: "b", value: "2"}}})
+	is.NoErr(err)
+	// the snapshot is renamed into place, but the process stops before the log is truncated
+	b, err := os.ReadFile(walPath(path))
+	is.NoErr(err)
+	is.NoErr(db.persist())
+	is.NoErr(db.wal.f.Close())
+	is.NoErr(os.WriteFile(walPath(path), b, filePerm))
+
+	restored, err := openDatabase(path, l, false, syncAlways, log)
+	is.NoErr(err)
+	defer restored.wal.close()
+	is.Equal(restored.db, db.db)
+	is.Equal(restored.rev, db.rev)
+	_, _, err = restored.put("b", "3", putOptions{})
+	is.NoErr(err)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// watchHistory is the number of changes kept to resume watches
+	watchHistory = 1000
+	// watchBuffer is the number of changes a watcher may fall behind before it is dropped
+	watchBuffer       = 256
+	heartbeatInterval = 15 * time.Second
+)
+
+const (
+	changePut    = "put"
+	changeDelete = "delete"
+)
+
+// change is a put or delete of a key at a revision.
+type change struct {
+	op    string
+	key   string
+	value string
+	rev   uint64
+}
+
+func changeOf(r walRecord) change {
+	if r.op == walOpDelete {
+		return change{op: changeDelete, key: r.key, rev: r.version}
+	}
+	return change{op: changePut, key: r.key, value: r.value, rev: r.version}
+}
+
+// watchOptions select the changes of a watch.
+type watchOptions struct {
+	key string
+	// prefix matches all keys starting with key instead of key only
+	prefix bool
+	// rev is the first revision to send, 0 only sends new changes
+	rev uint64
+}
+
+func (o watchOptions) match(key string) bool {
+	if o.prefix {
+		return strings.HasPrefix(key, o.key)
+	}
+	return key == o.key
+}
+
+// CompactedError is returned for a watch that starts at a revision no longer in the history.
+type CompactedError struct {
+	rev   uint64
+	floor uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("error: revision %d is compacted, the oldest available revision is %d", e.rev, e.floor)
+}
+
+// subscription receives the changes of a watch, the changes of a revision arrive together.
+// c is closed if the watcher falls too far behind.
+type subscription struct {
+	c    chan []change
+	opts watchOptions
+	// rev is the revision of the last write before the subscription
+	rev uint64
+}
+
+// feed keeps the latest changes and fans them out to subscriptions.
+// Changes are published in revision order, the changes of a transaction share a revision.
+type feed struct {
+	mu      sync.Mutex
+	history []change
+	subs    map[*subscription]struct{}
+}
+
+func newFeed() *feed {
+	return &feed{subs: make(map[*subscription]struct{})}
+}
+
+// publish records the changes of a revision and sends them to all matching subscriptions without blocking.
+func (f *feed) publish(changes ...change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.history = append(f.history, changes...)
+	for len(f.history) > watchHistory {
+		// drop all changes of the oldest revision, so a revision is either complete or gone
+		drop := 1
+		for drop < len(f.history) && f.history[drop].rev == f.history[0].rev {
+			drop++
+		}
+		f.history = append(f.history[:0:0], f.history[drop:]...)
+	}
+	for sub := range f.subs {
+		var matched []change
+		for _, c := range changes {
+			if sub.opts.match(c.key) {
+				matched = append(matched, c)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		select {
+		case sub.c <- matched:
+		default:
+			close(sub.c)
+			delete(f.subs, sub)
+		}
+	}
+}
+
+// subscribe returns the changes since opts.rev and registers a subscription for new ones.
+// next is the revision of the next write, it's the oldest available revision if there is no history.
+func (f *feed) subscribe(opts watchOptions, next uint64) (*subscription, []change, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var backlog []change
+	if opts.rev > 0 {
+		floor := next
+		if len(f.history) > 0 {
+			floor = f.history[0].rev
+		}
+		if opts.rev < floor {
+			return nil, nil, &CompactedError{rev: opts.rev, floor: floor}
+		}
+		for _, c := range f.history {
+			if c.rev >= opts.rev && opts.match(c.key) {
+				backlog = append(backlog, c)
+			}
+		}
+	}
+	sub := &subscription{c: make(chan []change, watchBuffer), opts: opts, rev: next - 1}
+	f.subs[sub] = struct{}{}
+	return sub, backlog, nil
+}
+
+func (f *feed) unsubscribe(sub *subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[sub]; ok {
+		close(sub.c)
+		delete(f.subs, sub)
+	}
+}
+
+// notify publishes the changes of a revision to the watchers, the caller must hold db.mu.
+func (db *database) notify(changes ...change) {
+	db.changes.publish(changes...)
+}
+
+func (db *database) watch(opts watchOptions) (*subscription, []change, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.changes.subscribe(opts, db.rev+1)
+}
+
+func (db *database) unwatch(sub *subscription) {
+	db.changes.unsubscribe(sub)
+}
+
+// parseWatchOptions reads the key or prefix to watch and the revision to start from.
+// The revision is the rev query parameter or the revision after the Last-Event-ID of a reconnect.
+func parseWatchOptions(r *http.Request) (watchOptions, error) {
+	opts, err := parseWatchKey(r.URL.Query())
+	if err != nil {
+		return opts, err
+	}
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("error: Last-Event-ID %q is not a revision", v) //nolint:goerr113
+		}
+		opts.rev = id + 1
+	} else if v := r.URL.Query().Get("rev"); v != "" {
+		rev, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("error: rev %q is not a revision", v) //nolint:goerr113
+		}
+		opts.rev = rev
+	}
+	return opts, nil
+}
+
+// parseWatchKey reads the key or the prefix to watch, without either all keys are watched.
+func parseWatchKey(q url.Values) (watchOptions, error) {
+	var opts watchOptions
+	switch {
+	case q.Has("key") && q.Has("prefix"):
+		return opts, errors.New("error: use either key or prefix") //nolint:goerr113
+	case q.Has("key"):
+		opts.key = q.Get("key")
+	default:
+		opts.key, opts.prefix = q.Get("prefix"), true
+	}
+	return opts, nil
+}
+
+type watchEvent struct {
+	Key      string  `json:"key"`
+	Value    *string `json:"value,omitempty"`
+	Encoding string  `json:"encoding,omitempty"`
+	Revision uint64  `json:"revision"`
+}
+
+// handleWatch streams the changes of a key or prefix as server-sent events.
+// Every event has the revision as id, the operation as type and the change as JSON data.
+// The stream ends if the client falls too far behind, it can resume with the Last-Event-ID.
+func (s *server) handleWatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wt, ok := s.store(r).(watcher)
+		if !ok {
+			s.writeError(w, r, &UnsupportedError{feature: "watches"})
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.writeError(w, r, errors.New("error: streaming is not supported")) //nolint:goerr113
+			return
+		}
+		opts, err := parseWatchOptions(r)
+		if err != nil {
+			s.writeError(w, r, &RequestError{err: err})
+			return
+		}
+		if err := s.authorize(r, opts.key, permRead); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		sub, backlog, err := wt.watch(opts)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		defer wt.unwatch(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		for _, c := range backlog {
+			if err := writeEvent(w, c); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case changes, ok := <-sub.c:
+				if !ok {
+					s.log.Info("dropped slow watcher", "key", opts.key)
+					return
+				}
+				for _, c := range changes {
+					if err := writeEvent(w, c); err != nil {
+						return
+					}
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, c change) error {
+	ev := watchEvent{Key: c.key, Revision: c.rev}
+	if c.op == changePut {
+		ev.Value, ev.Encoding = jsonValue(c.value)
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("can't encode event: %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.rev, c.op, data); err != nil {
+		return fmt.Errorf("can't write event: %w", err)
+	}
+	return nil
+}
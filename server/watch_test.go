@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestDatabaseWatch(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	db := newDatabase("", defaultLimits())
+	db.now = clock.now
+	_, _, err := db.put("a/1", "1", putOptions{})
+	is.NoErr(err)
+
+	sub, backlog, err := db.watch(watchOptions{key: "a/", prefix: true, rev: 1})
+	is.NoErr(err)
+	defer db.unwatch(sub)
+	is.Equal(backlog, []change{{op: changePut, key: "a/1", value: "1", rev: 1}})
+
+	_, _, err = db.put("b", "2", putOptions{})
+	is.NoErr(err)
+	_, _, err = db.put("a/2", "2", putOptions{ttl: time.Second})
+	is.NoErr(err)
+	is.NoErr(db.delete("a/1", precondition{}))
+	clock.t = clock.t.Add(time.Second)
+	is.Equal(db.reap(), 1)
+
+	var got []change
+	for len(got) < 3 {
+		got = append(got, <-sub.c...)
+	}
+	is.Equal(got, []change{
+		{op: changePut, key: "a/2", value: "2", rev: 3},
+		{op: changeDelete, key: "a/1", rev: 4},
+		{op: changeDelete, key: "a/2", rev: 5},
+	})
+}
+
+func TestFeed(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	f := newFeed()
+	for rev := uint64(1); rev <= watchHistory+1; rev++ {
+		f.publish(change{op: changePut, key: "a", rev: rev})
+	}
+	var compactedErr *CompactedError
+	_, _, err := f.subscribe(watchOptions{key: "a", rev: 1}, watchHistory+2)
+	is.True(errors.As(err, &compactedErr))
+	sub, backlog, err := f.subscribe(watchOptions{key: "a", rev: watchHistory + 1}, watchHistory+2)
+	is.NoErr(err)
+	is.Equal(len(backlog), 1)
+
+	// a subscription that falls too far behind is closed
+	for i := 0; i < watchBuffer+1; i++ {
+		f.publish(change{op: changePut, key: "a", rev: watchHistory + 2})
+	}
+	n := 0
+	for range sub.c {
+		n++
+	}
+	is.Equal(n, watchBuffer)
+	f.unsubscribe(sub)
+
+	// without history a watch can start at the next revision only
+	f = newFeed()
+	_, _, err = f.subscribe(watchOptions{rev: 4}, 5)
+	is.True(errors.As(err, &compactedErr))
+	_, _, err = f.subscribe(watchOptions{rev: 5}, 5)
+	is.NoErr(err)
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	s := testServer(map[string]string{})
+	s.routes()
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	_, _, err := s.db.put("a", "1", putOptions{})
+	is.NoErr(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/watch?key=a&rev=1", nil)
+	is.NoErr(err)
+	resp, err := http.DefaultClient.Do(req)
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(resp.Header.Get("Content-Type"), "text/event-stream")
+
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			is.NoErr(err)
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	is.Equal(readEvent(), "id: 1\nevent: put\ndata: {\"key\":\"a\",\"value\":\"1\",\"revision\":1}\n")
+	_, _, err = s.db.put("b", "2", putOptions{})
+	is.NoErr(err)
+	is.NoErr(s.db.delete("a", precondition{}))
+	is.Equal(readEvent(), "id: 3\nevent: delete\ndata: {\"key\":\"a\",\"revision\":3}\n")
+}
+
+func TestWatchRequest(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		query       string
+		lastEventID string
+		code        int
+	}{
+		{name: "key and prefix", query: "?key=a&prefix=b", code: http.StatusBadRequest},
+		{name: "invalid rev", query: "?rev=x", code: http.StatusBadRequest},
+		{name: "invalid last event id", lastEventID: "x", code: http.StatusBadRequest},
+		{name: "compacted", query: "?rev=1", code: http.StatusGone},
+		{name: "resume from the future", lastEventID: "7", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			s := testServer(map[string]string{})
+			s.db.(*database).rev = 5
+			ctx, cancel := context.WithCancel(context.Background())
+			req := httptest.NewRequest(http.MethodGet, "/watch"+tt.query, nil).WithContext(ctx)
+			if tt.lastEventID != "" {
+				req.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+			// the stream ends once the client is gone
+			cancel()
+			w := httptest.NewRecorder()
+			s.serveHTTP(w, req)
+			is.Equal(w.Code, tt.code)
+		})
+	}
+}